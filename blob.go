@@ -0,0 +1,365 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"time"
+)
+
+// blobSchema maps content digests to the file ids holding blob content.
+// Blobs have no file_metadata row; their fragments live in file_fragments
+// like those of any file.
+const blobSchema = `
+	CREATE TABLE IF NOT EXISTS content_blobs (
+		digest BLOB PRIMARY KEY,
+		file_id INTEGER NOT NULL UNIQUE,
+		size INTEGER NOT NULL,
+		codec TEXT,
+		key_id TEXT,
+		data_key BLOB,
+		chunked INTEGER,
+		created_at INTEGER NOT NULL
+	);
+`
+
+// blobMIMEType is reported for blobs, which have no name to detect a type
+// from.
+const blobMIMEType = "application/octet-stream"
+
+// copyPageSize is the number of encrypted fragments BindBlob re-seals per
+// query.
+const copyPageSize = 64
+
+// errBlobRemoved is returned when a blob is removed while BindBlob copies
+// it.
+var errBlobRemoved = errors.New("sqlitefs: blob was removed")
+
+// PutBlob stores the content of r as a blob and returns its SHA-256 digest,
+// the same digest Hash reports for a file with that content. Blobs have no
+// path: OpenBlob reads them and BindBlob makes them the content of paths.
+// Putting content that is stored already keeps the existing blob. Unless
+// encryption is enabled, blob fragments are deduplicated even without
+// WithDeduplication, so binding a blob to many paths stores it once.
+func (fs *SQLiteFS) PutBlob(r io.Reader) ([]byte, error) {
+	w := newWriter(fs, "")
+	w.blobCommit, w.dedup = true, true
+	if _, err := w.ReadFrom(r); err != nil {
+		// Make Close discard what was written
+		if w.err == nil {
+			w.err = err
+		}
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.hash.Sum(nil), nil
+}
+
+// OpenBlob opens the blob with the given digest for reading. The handle
+// supports Seek, ReadAt and WriteTo like those of files, and its Stat names
+// it after the hex digest. It keeps reading even if the blob is removed
+// meanwhile.
+func (fs *SQLiteFS) OpenBlob(digest []byte) (iofs.File, error) {
+	name := hex.EncodeToString(digest)
+	file := &SQLiteFile{
+		fs:          fs,
+		db:          fs.readDB,
+		path:        name,
+		lastReadEnd: -1,
+	}
+
+	for {
+		var gen uint64
+		if fs.versions != nil {
+			gen = fs.versions.generation()
+		}
+		meta, created, err := fs.statBlob(digest)
+		if err != nil {
+			return nil, err
+		}
+		if !meta.exists {
+			return nil, &PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := file.load(meta); err != nil {
+			return nil, &PathError{Op: "open", Path: name, Err: err}
+		}
+		file.info = &fileInfo{
+			name:     name,
+			size:     meta.size,
+			modTime:  created,
+			mimeType: blobMIMEType,
+			sha256:   bytes.Clone(digest),
+		}
+
+		// Pin the blob so its fragments outlive RemoveBlob
+		if fs.versions == nil {
+			break
+		}
+		if fs.versions.acquire(meta.id, gen) {
+			file.tracked = true
+			break
+		}
+	}
+	return file, nil
+}
+
+// BindBlob makes the blob with the given digest the content of path, as if
+// it had been written there, without reading or storing the content again:
+// the new version refers to the fragments of the blob. The path can be
+// replaced and removed like any other, and the blob stays until RemoveBlob.
+// In WriteExclusive mode it fails with ErrWriteInProgress while the path
+// has an open writer.
+func (fs *SQLiteFS) BindBlob(path string, digest []byte) error {
+	if fs.writerMode == WriteExclusive {
+		if !fs.claimPath(path) {
+			return &PathError{Op: "bind", Path: path, Err: ErrWriteInProgress}
+		}
+		defer fs.releasePath(path)
+	}
+
+	meta, _, err := fs.statBlob(digest)
+	if err != nil {
+		return err
+	}
+	if !meta.exists {
+		return &PathError{Op: "bind", Path: path, Err: os.ErrNotExist}
+	}
+
+	res := fs.request(writeRequest{op: opReserve, path: path})
+	if res.err != nil {
+		return res.err
+	}
+	err = fs.request(writeRequest{
+		op:      opCopyBlob,
+		path:    path,
+		fileID:  res.fileID,
+		source:  meta.id,
+		sha256:  digest,
+		keyID:   meta.keyID,
+		dataKey: meta.dataKey,
+	}).err
+	if err == nil {
+		err = fs.request(writeRequest{
+			op:       opCommit,
+			path:     path,
+			fileID:   res.fileID,
+			mimeType: detectMIMEType(path),
+			sha256:   digest,
+			codec:    meta.codec,
+			size:     meta.size,
+			chunked:  meta.chunked,
+			keyID:    meta.keyID,
+			dataKey:  meta.dataKey,
+		}).err
+	}
+	if err != nil {
+		fs.request(writeRequest{op: opDiscard, path: path, fileID: res.fileID})
+		if errors.Is(err, errBlobRemoved) {
+			return &PathError{Op: "bind", Path: path, Err: os.ErrNotExist}
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveBlob deletes the blob with the given digest. Paths it was bound to
+// keep their content, and handles from OpenBlob keep reading until closed.
+func (fs *SQLiteFS) RemoveBlob(digest []byte) error {
+	var fileID int64
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`SELECT file_id FROM content_blobs WHERE digest = ?`, digest).Scan(&fileID)
+		if err == sql.ErrNoRows {
+			return &PathError{Op: "remove", Path: hex.EncodeToString(digest), Err: os.ErrNotExist}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM content_blobs WHERE digest = ?`, digest); err != nil {
+			return err
+		}
+		_, err = tx.Stmt(fs.stmts.insertReclaim).Exec(fileID, reclaimUnlinked, time.Now().Unix(), fs.owner())
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	return fs.unlinkVersion(fileID)
+}
+
+// statBlob looks up the stored content of a blob; meta.exists is false if
+// there is none.
+func (fs *SQLiteFS) statBlob(digest []byte) (meta fileMeta, created time.Time, err error) {
+	var codec, keyID sql.NullString
+	var createdAt int64
+	err = fs.retry(context.Background(), func() error {
+		return fs.stmts.blobByDigest.QueryRow(digest).Scan(&meta.id, &meta.size, &codec, &keyID, &meta.dataKey, &meta.chunked, &createdAt)
+	})
+	if err == sql.ErrNoRows {
+		return meta, created, nil
+	}
+	if err != nil {
+		return meta, created, err
+	}
+	meta.exists = true
+	meta.mimeType = blobMIMEType
+	meta.sha256 = digest
+	meta.codec = codec.String
+	meta.keyID = keyID.String
+	return meta, time.Unix(createdAt, 0), nil
+}
+
+// commitBlob stores a written version as the blob named by its digest. If
+// that blob exists already, the new copy is dropped in the same
+// transaction.
+func (fs *SQLiteFS) commitBlob(req writeRequest) error {
+	var codec, keyID, chunked any
+	if req.codec != "" {
+		codec = req.codec
+	}
+	if req.keyID != "" {
+		keyID = req.keyID
+	}
+	if req.chunked {
+		chunked = true
+	}
+
+	return fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Stmt(fs.stmts.deleteUpload).Exec(req.fileID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errUploadReclaimed
+		}
+
+		result, err = tx.Exec(`
+			INSERT OR IGNORE INTO content_blobs (digest, file_id, size, codec, key_id, data_key, chunked, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			req.sha256, req.fileID, req.size, codec, keyID, req.dataKey, chunked, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// Nothing can read the new copy yet
+			if _, err := tx.Stmt(fs.stmts.deleteFragmentsByID).Exec(req.fileID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// copyBlob copies the fragments of the blob req.source to the uncommitted
+// version req.fileID. Encrypted fragments are bound to their file id, so
+// they are re-sealed for the new one under the same data key; all others
+// are copied as stored, which for deduplicated ones only adds references.
+func (fs *SQLiteFS) copyBlob(req writeRequest) error {
+	ctx := context.Background()
+	aead, err := fs.dataCipher(ctx, req.keyID, req.dataKey)
+	if err != nil {
+		return err
+	}
+
+	return fs.retry(ctx, func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var found bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM content_blobs WHERE digest = ? AND file_id = ?)`, req.sha256, req.source).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errBlobRemoved
+		}
+
+		if aead == nil {
+			_, err = tx.Exec(`
+				INSERT INTO file_fragments (file_id, fragment_index, fragment, crc32c, blob, byte_offset)
+				SELECT ?, fragment_index, fragment, crc32c, blob, byte_offset
+				FROM file_fragments
+				WHERE file_id = ?`, req.fileID, req.source)
+			if err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+
+		type storedFragment struct {
+			index  int64
+			data   []byte
+			offset sql.NullInt64
+		}
+		insert := tx.Stmt(fs.stmts.insertFragment)
+		for next := int64(0); ; {
+			// Load a page before writing so no rows stay open meanwhile
+			var page []storedFragment
+			rows, err := tx.Query(`
+				SELECT fragment_index, fragment, byte_offset
+				FROM file_fragments
+				WHERE file_id = ? AND fragment_index >= ?
+				ORDER BY fragment_index
+				LIMIT ?`, req.source, next, copyPageSize)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var f storedFragment
+				if err := rows.Scan(&f.index, &f.data, &f.offset); err != nil {
+					rows.Close()
+					return err
+				}
+				page = append(page, f)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if len(page) == 0 {
+				return tx.Commit()
+			}
+
+			for _, f := range page {
+				plaintext, err := unseal(aead, f.data, fragmentAAD(req.source, f.index))
+				if err != nil {
+					return &PathError{Op: "bind", Path: req.path, Err: fmt.Errorf("fragment %d: %w", f.index, ErrDecrypt)}
+				}
+				sealed, err := seal(aead, plaintext, fragmentAAD(req.fileID, f.index))
+				if err != nil {
+					return err
+				}
+				if _, err := insert.Exec(req.fileID, f.index, sealed, checksum(sealed), f.offset); err != nil {
+					return err
+				}
+			}
+			next = page[len(page)-1].index + 1
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package sqlitefs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// fragmentEntryOverhead approximates the bookkeeping cost of a cached
+// fragment so that many tiny fragments still count against the budget.
+const fragmentEntryOverhead = 64
+
+// CacheStats reports the effectiveness of the shared fragment cache.
+type CacheStats struct {
+	Hits      int64 // fragments served from memory
+	Misses    int64 // fragments loaded from the database
+	Evictions int64 // fragments dropped to stay within the budget
+	Entries   int   // fragments currently cached
+	Bytes     int64 // memory currently accounted to cached fragments
+}
+
+// fragmentKey identifies a fragment of one version of a file. File ids are
+// AUTOINCREMENT and never reused, so a rewritten file gets a new id and old
+// entries can't be mistaken for the new content.
+type fragmentKey struct {
+	fileID int64
+	index  int64
+}
+
+type cachedFragment struct {
+	key  fragmentKey
+	data []byte
+}
+
+// fragmentCache is a memory-bounded LRU cache of fragment contents shared by
+// all handles of a SQLiteFS. Cached slices are never modified.
+type fragmentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	lru      *list.List // front is most recently used
+	entries  map[fragmentKey]*list.Element
+	byFile   map[int64]map[int64]*list.Element
+	stats    CacheStats
+}
+
+func newFragmentCache(maxBytes int64) *fragmentCache {
+	return &fragmentCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[fragmentKey]*list.Element),
+		byFile:   make(map[int64]map[int64]*list.Element),
+	}
+}
+
+// get returns the cached fragment and marks it as recently used.
+func (c *fragmentCache) get(fileID, index int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[fragmentKey{fileID, index}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	return elem.Value.(*cachedFragment).data, true
+}
+
+// put records a fragment that was loaded from the database.
+func (c *fragmentCache) put(fileID, index int64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Misses++
+
+	cost := int64(len(data)) + fragmentEntryOverhead
+	if cost > c.maxBytes {
+		return
+	}
+
+	key := fragmentKey{fileID, index}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+
+	elem := c.lru.PushFront(&cachedFragment{key: key, data: data})
+	c.entries[key] = elem
+	if c.byFile[fileID] == nil {
+		c.byFile[fileID] = make(map[int64]*list.Element)
+	}
+	c.byFile[fileID][index] = elem
+	c.stats.Entries++
+	c.stats.Bytes += cost
+
+	for c.stats.Bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidateFile drops every cached fragment of a file.
+func (c *fragmentCache) invalidateFile(fileID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, elem := range c.byFile[fileID] {
+		c.removeElement(elem)
+	}
+}
+
+func (c *fragmentCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedFragment)
+	delete(c.entries, entry.key)
+	if fragments := c.byFile[entry.key.fileID]; fragments != nil {
+		delete(fragments, entry.key.index)
+		if len(fragments) == 0 {
+			delete(c.byFile, entry.key.fileID)
+		}
+	}
+	c.stats.Entries--
+	c.stats.Bytes -= int64(len(entry.data)) + fragmentEntryOverhead
+}
+
+func (c *fragmentCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
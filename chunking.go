@@ -0,0 +1,122 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/bits"
+)
+
+// maxChunkSize is the largest Chunking.Max accepted.
+const maxChunkSize = 16 << 20
+
+// Chunking configures content-defined chunking. Fragment boundaries are
+// placed where a rolling hash over the last bytes matches a pattern, so an
+// insertion or deletion only changes the fragments around it and the rest
+// still deduplicate against earlier versions. Fragments are at least Min and
+// at most Max bytes long and Avg bytes on average. The zero value stores
+// fixed 16 KiB fragments.
+type Chunking struct {
+	Min, Avg, Max int
+}
+
+// DefaultChunking suits files that are edited in place, such as documents
+// and source archives.
+var DefaultChunking = Chunking{Min: 4 << 10, Avg: 16 << 10, Max: 64 << 10}
+
+func (c Chunking) validate() error {
+	if c.Min < 64 || c.Min > c.Avg || c.Avg > c.Max || c.Max > maxChunkSize {
+		return fmt.Errorf("sqlitefs: invalid chunking %+v: need 64 <= Min <= Avg <= Max <= %d", c, maxChunkSize)
+	}
+	return nil
+}
+
+// gear maps each byte to a random value for the rolling hash. Boundaries
+// depend on it, so changing it stops new fragments from matching old ones.
+var gear = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed
+	x := uint64(0x73716c6974656673)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// chunker finds content-defined boundaries with a gear hash, using a
+// stricter pattern below Avg and a looser one above it, which keeps chunk
+// sizes close to Avg (FastCDC's normalized chunking).
+type chunker struct {
+	min, avg, max int
+	strict, loose uint64 // masks over the high hash bits
+	hash          uint64
+	pos           int // bytes of the current chunk scanned so far
+}
+
+func newChunker(c Chunking) *chunker {
+	avgBits := bits.Len(uint(c.Avg)) - 1
+	return &chunker{
+		min:    c.Min,
+		avg:    c.Avg,
+		max:    c.Max,
+		strict: ^uint64(0) << (64 - min(avgBits+1, 63)),
+		loose:  ^uint64(0) << (64 - max(avgBits-1, 1)),
+	}
+}
+
+// cut returns the length of the chunk at the start of buf, or 0 while buf
+// holds no boundary yet. Calls continue scanning where the previous one
+// stopped until a chunk is returned, so buf must only grow in between.
+func (c *chunker) cut(buf []byte) int {
+	n := min(len(buf), c.max)
+	i := max(c.pos, c.min)
+	for ; i < n; i++ {
+		c.hash = c.hash<<1 + gear[buf[i]]
+		mask := c.loose
+		if i < c.avg {
+			mask = c.strict
+		}
+		if c.hash&mask == 0 {
+			c.hash, c.pos = 0, 0
+			return i + 1
+		}
+	}
+	c.pos = i
+	if n == c.max {
+		c.hash, c.pos = 0, 0
+		return n
+	}
+	return 0
+}
+
+// locate returns the index of the fragment holding pos and the offset the
+// fragment starts at. Fixed-size fragments are found by arithmetic, chunks
+// through the offsets stored with them.
+func (f *SQLiteFile) locate(pos int64) (index, start int64, err error) {
+	if !f.chunked {
+		index = pos / fragmentSize
+		return index, index * fragmentSize, nil
+	}
+	err = f.fs.retry(context.Background(), func() error {
+		stmt, err := f.fs.stmts.get(&f.fs.stmts.chunkAt)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRow(f.fileID, pos).Scan(&index, &start)
+	})
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return index, start, err
+}
+
+// fragmentStart returns the offset fragment index starts at, given the
+// offset and length of the fragment before it.
+func (f *SQLiteFile) fragmentStart(index, prevStart int64, prevLen int) int64 {
+	if !f.chunked {
+		return index * fragmentSize
+	}
+	return prevStart + int64(prevLen)
+}
@@ -0,0 +1,179 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Codec compresses file content. Every fragment is compressed on its own,
+// so reads and seeks only decompress the fragments they touch. The name is
+// stored with each file and selects the codec again when the file is read,
+// so it must stay the same for the same format.
+type Codec interface {
+	Name() string
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the original form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Flate returns a codec storing fragments as raw DEFLATE streams,
+// compressed at the given compress/flate level.
+func Flate(level int) Codec {
+	return &streamCodec{
+		name: "flate",
+		newWriter: func(w io.Writer) (streamWriter, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+}
+
+// Gzip returns a codec storing fragments as gzip streams, compressed at the
+// given compress/gzip level.
+func Gzip(level int) Codec {
+	return &streamCodec{
+		name: "gzip",
+		newWriter: func(w io.Writer) (streamWriter, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+}
+
+// streamWriter is the part of flate.Writer and gzip.Writer streamCodec uses.
+type streamWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// streamCodec adapts a compress/* stream format to Codec. Compressors are
+// expensive to set up and are pooled.
+type streamCodec struct {
+	name      string
+	newWriter func(io.Writer) (streamWriter, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+	writers   sync.Pool
+}
+
+func (c *streamCodec) Name() string { return c.name }
+
+func (c *streamCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw, ok := c.writers.Get().(streamWriter)
+	if ok {
+		zw.Reset(buf)
+	} else {
+		var err error
+		if zw, err = c.newWriter(buf); err != nil {
+			return dst, err
+		}
+	}
+	defer c.writers.Put(zw)
+
+	if _, err := zw.Write(src); err != nil {
+		return dst, err
+	}
+	if err := zw.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(dst, src []byte) ([]byte, error) {
+	zr, err := c.newReader(bytes.NewReader(src))
+	if err != nil {
+		return dst, err
+	}
+	defer zr.Close()
+
+	buf := bytes.NewBuffer(dst)
+	_, err = buf.ReadFrom(zr)
+	return buf.Bytes(), err
+}
+
+// builtinCodecs can be read by every SQLiteFS without registering them.
+var builtinCodecs = map[string]Codec{
+	"flate": Flate(flate.DefaultCompression),
+	"gzip":  Gzip(gzip.DefaultCompression),
+}
+
+// compressedTypes are MIME types whose content is already compressed.
+// Compression rules never apply to them.
+var compressedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+	"audio/*", "video/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed",
+	"application/vnd.rar", "application/java-archive", "application/epub+zip",
+}
+
+// compressionRule selects a codec for the MIME types matching one of its
+// patterns.
+type compressionRule struct {
+	codec    Codec
+	patterns []string // "type/subtype" or "type/*"; empty matches everything
+}
+
+// detectMIMEType returns the MIME type stored for a file at path.
+func detectMIMEType(path string) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+// matchMIMEType reports whether mimeType, parameters ignored, matches one of
+// the patterns.
+func matchMIMEType(mimeType string, patterns []string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.TrimSpace(mimeType)
+	for _, pattern := range patterns {
+		if pattern == mimeType || pattern == "*" || pattern == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// codecForType returns the codec the compression rules pick for new files
+// of mimeType, or nil to store them uncompressed.
+func (fs *SQLiteFS) codecForType(mimeType string) Codec {
+	if matchMIMEType(mimeType, compressedTypes) {
+		return nil
+	}
+	for _, rule := range fs.compression {
+		if len(rule.patterns) == 0 || matchMIMEType(mimeType, rule.patterns) {
+			return rule.codec
+		}
+	}
+	return nil
+}
+
+// codec returns the codec with the given name, preferring those passed to
+// WithCompression or WithCodec over the built-in ones.
+func (fs *SQLiteFS) codec(name string) (Codec, error) {
+	if c, ok := fs.codecs[name]; ok {
+		return c, nil
+	}
+	if c, ok := builtinCodecs[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("sqlitefs: unknown codec %q", name)
+}
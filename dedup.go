@@ -0,0 +1,142 @@
+package sqlitefs
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+)
+
+// dedupSchema stores deduplicated fragments once per content hash. Fragment
+// rows referring to a blob keep an empty fragment and the blob's CRC-32C, so
+// a missing blob reads as a corrupt fragment. The reference count follows
+// the fragment rows through triggers, which makes every way of deleting
+// fragments - reclaim, Remove, Repair - release blobs as well.
+const dedupSchema = `
+	CREATE TABLE IF NOT EXISTS fragment_blobs (
+		hash BLOB PRIMARY KEY,
+		fragment BLOB NOT NULL,
+		refs INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS idx_file_fragments_blob ON file_fragments(blob) WHERE blob IS NOT NULL;
+	CREATE TRIGGER IF NOT EXISTS fragment_blobs_ref AFTER INSERT ON file_fragments
+	WHEN NEW.blob IS NOT NULL BEGIN
+		UPDATE fragment_blobs SET refs = refs + 1 WHERE hash = NEW.blob;
+	END;
+	CREATE TRIGGER IF NOT EXISTS fragment_blobs_unref AFTER DELETE ON file_fragments
+	WHEN OLD.blob IS NOT NULL BEGIN
+		UPDATE fragment_blobs SET refs = refs - 1 WHERE hash = OLD.blob;
+		DELETE FROM fragment_blobs WHERE hash = OLD.blob AND refs <= 0;
+	END;
+`
+
+// DedupStats describes the fragments stored by WithDeduplication.
+type DedupStats struct {
+	References   int64 // fragments referring to a blob
+	Blobs        int64 // distinct blobs stored
+	LogicalBytes int64 // bytes of all references together
+	StoredBytes  int64 // bytes of the distinct blobs
+}
+
+// Ratio returns how many bytes are referenced per byte stored, 1 if
+// nothing is stored deduplicated.
+func (s DedupStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+// DedupStats reports how much deduplication saves. Fragments written
+// without WithDeduplication are not counted.
+func (fs *SQLiteFS) DedupStats() (DedupStats, error) {
+	var s DedupStats
+	err := fs.retry(context.Background(), func() error {
+		return fs.readDB.QueryRow(`
+			SELECT COALESCE(SUM(refs), 0), COUNT(*),
+				COALESCE(SUM(refs * LENGTH(fragment)), 0), COALESCE(SUM(LENGTH(fragment)), 0)
+			FROM fragment_blobs`).Scan(&s.References, &s.Blobs, &s.LogicalBytes, &s.StoredBytes)
+	})
+	return s, err
+}
+
+// writeBlobFragment stores a fragment as a reference to the blob named by
+// req.blob, storing the blob first unless it exists already.
+func (fs *SQLiteFS) writeBlobFragment(req writeRequest) error {
+	return fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Stmt(fs.stmts.insertBlob).Exec(req.blob, req.data); err != nil {
+			return err
+		}
+		_, err = tx.Stmt(fs.stmts.insertBlobRef).Exec(req.fileID, req.index, checksum(req.data), req.blob, req.byteOffset())
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// checkBlobs finds blobs whose reference count differs from the number of
+// fragments referring to them.
+func (fs *SQLiteFS) checkBlobs(ctx context.Context) ([]Problem, error) {
+	var problems []Problem
+	err := fs.retry(ctx, func() error {
+		problems = problems[:0]
+		rows, err := fs.readDB.QueryContext(ctx, `
+			SELECT hash, refs, found FROM (
+				SELECT hash, refs, (SELECT COUNT(*) FROM file_fragments WHERE blob = hash) AS found
+				FROM fragment_blobs
+			)
+			WHERE refs != found
+			ORDER BY hash`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hash []byte
+			var refs, found int64
+			if err := rows.Scan(&hash, &refs, &found); err != nil {
+				return err
+			}
+			problems = append(problems, Problem{
+				Kind:   ProblemBlobRefs,
+				Index:  -1,
+				Blob:   hash,
+				Detail: fmt.Sprintf("blob %s has %d references recorded, %d found", hex.EncodeToString(hash), refs, found),
+			})
+		}
+		return rows.Err()
+	})
+	return problems, err
+}
+
+// fixBlobRefs sets the reference count of a blob to the number of fragments
+// referring to it, deleting it if there are none.
+func (fs *SQLiteFS) fixBlobRefs(hash []byte) (deleted bool, err error) {
+	err = fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`UPDATE fragment_blobs SET refs = (SELECT COUNT(*) FROM file_fragments WHERE blob = ?1) WHERE hash = ?1`, hash)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(`DELETE FROM fragment_blobs WHERE hash = ? AND refs = 0`, hash)
+		if err != nil {
+			return err
+		}
+		n, _ := result.RowsAffected()
+		deleted = n > 0
+		return tx.Commit()
+	})
+	return deleted, err
+}
@@ -0,0 +1,302 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// dataKeySize is the length of the AES-256 key generated for every file.
+const dataKeySize = 32
+
+// rotatePageSize is the number of files RotateKeys re-wraps per transaction.
+const rotatePageSize = 256
+
+// ErrUnknownKey is returned by StaticKeys for a master key it does not hold.
+var ErrUnknownKey = errors.New("sqlitefs: unknown master key")
+
+// ErrDecrypt is wrapped by read errors for fragments that fail
+// authentication, meaning they were altered or belong to another file or
+// position.
+var ErrDecrypt = errors.New("sqlitefs: fragment cannot be decrypted")
+
+// KeyProvider supplies the master keys protecting encrypted files. Every
+// file is encrypted with a data key of its own, which is stored wrapped with
+// a master key; master keys never reach the database, only their IDs do.
+type KeyProvider interface {
+	// CurrentKey returns the master key that wraps the data keys of new
+	// files, and its ID. Keys are 16, 24 or 32 bytes long for AES-128,
+	// AES-192 or AES-256.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the master key with an ID CurrentKey has returned before.
+	// It is called whenever an encrypted file is opened, so providers
+	// backed by a remote service should cache.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its master keys in memory, keyed by
+// ID. Current names the key wrapping new data keys.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := k.Key(ctx, k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(_ context.Context, id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// newGCM returns AES-GCM for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the
+// result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plaintext, additionalData), nil
+}
+
+// unseal reverses seal.
+func unseal(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sqlitefs: sealed data is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// fragmentAAD binds an encrypted fragment to its file and position, so
+// fragments cannot be swapped, reordered or moved to another file.
+func fragmentAAD(fileID, index int64) []byte {
+	aad := make([]byte, 16)
+	binary.BigEndian.PutUint64(aad, uint64(fileID))
+	binary.BigEndian.PutUint64(aad[8:], uint64(index))
+	return aad
+}
+
+// wrapAAD binds a wrapped data key to the ID of the master key wrapping it.
+func wrapAAD(keyID string) []byte {
+	return []byte("sqlitefs data key\x00" + keyID)
+}
+
+// newDataKey generates the data key of a new file and returns its cipher
+// together with the key wrapped by the current master key.
+func (fs *SQLiteFS) newDataKey(ctx context.Context) (aead cipher.AEAD, keyID string, wrapped []byte, err error) {
+	keyID, master, err := fs.keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	wrapper, err := newGCM(master)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", nil, err
+	}
+	if wrapped, err = seal(wrapper, dataKey, wrapAAD(keyID)); err != nil {
+		return nil, "", nil, err
+	}
+	if aead, err = newGCM(dataKey); err != nil {
+		return nil, "", nil, err
+	}
+	return aead, keyID, wrapped, nil
+}
+
+// unwrapKey returns the data key wrapped with the master key keyID.
+func (fs *SQLiteFS) unwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if fs.keys == nil {
+		return nil, errors.New("sqlitefs: file is encrypted and no KeyProvider is set")
+	}
+	master, err := fs.keys.Key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	wrapper, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unseal(wrapper, wrapped, wrapAAD(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("sqlitefs: data key cannot be unwrapped with master key %q: %w", keyID, err)
+	}
+	return dataKey, nil
+}
+
+// dataCipher returns the cipher of a file stored with the given wrapped data
+// key, or nil if keyID is empty and the file is not encrypted.
+func (fs *SQLiteFS) dataCipher(ctx context.Context, keyID string, wrapped []byte) (cipher.AEAD, error) {
+	if keyID == "" {
+		return nil, nil
+	}
+	dataKey, err := fs.unwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+// decodeFragment turns a stored fragment back into file content by
+// decrypting it with aead and decompressing it with codec, either of which
+// may be nil. The result shares memory with stored only if both are.
+func decodeFragment(aead cipher.AEAD, codec Codec, fileID, index int64, stored []byte) ([]byte, error) {
+	data := stored
+	if aead != nil {
+		plaintext, err := unseal(aead, data, fragmentAAD(fileID, index))
+		if err != nil {
+			return nil, fmt.Errorf("fragment %d: %w", index, ErrDecrypt)
+		}
+		data = plaintext
+	}
+	if codec != nil {
+		decompressed, err := codec.Decompress(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("fragment %d: %w", index, err)
+		}
+		data = decompressed
+	}
+	return data, nil
+}
+
+// RotateKeys re-wraps the data keys of all files and blobs that are not
+// wrapped with the current master key, without touching their content.
+// Writers created before the KeyProvider switched keys still wrap with the
+// old one when they close, so they must be closed first, or RotateKeys run
+// again afterwards; old master keys must stay available until then. It
+// returns the number of re-wrapped files and blobs, also when it fails part
+// way; running it again resumes.
+func (fs *SQLiteFS) RotateKeys(ctx context.Context) (int, error) {
+	if fs.keys == nil {
+		return 0, errors.New("sqlitefs: no KeyProvider is set")
+	}
+	keyID, master, err := fs.keys.CurrentKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+	wrapper, err := newGCM(master)
+	if err != nil {
+		return 0, err
+	}
+
+	type wrappedKey struct {
+		id      int64
+		path    string
+		digest  []byte // set for blobs, which have no path
+		keyID   string
+		wrapped []byte
+	}
+	rotated := 0
+	var lastID int64
+	for {
+		var page []wrappedKey
+		err := fs.retry(ctx, func() error {
+			page = page[:0]
+			// Blobs and files never share a file id
+			rows, err := fs.readDB.QueryContext(ctx, `
+				SELECT id, path, NULL, key_id, data_key FROM file_metadata
+				WHERE id > ?1 AND key_id IS NOT NULL AND key_id != ?2
+				UNION ALL
+				SELECT file_id, '', digest, key_id, data_key FROM content_blobs
+				WHERE file_id > ?1 AND key_id IS NOT NULL AND key_id != ?2
+				ORDER BY 1 LIMIT ?3`, lastID, keyID, rotatePageSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var k wrappedKey
+				if err := rows.Scan(&k.id, &k.path, &k.digest, &k.keyID, &k.wrapped); err != nil {
+					return err
+				}
+				page = append(page, k)
+			}
+			return rows.Err()
+		})
+		if err != nil || len(page) == 0 {
+			return rotated, err
+		}
+
+		rewrapped := make([][]byte, len(page))
+		for i, k := range page {
+			dataKey, err := fs.unwrapKey(ctx, k.keyID, k.wrapped)
+			if err != nil {
+				name := k.path
+				if k.digest != nil {
+					name = hex.EncodeToString(k.digest)
+				}
+				return rotated, &PathError{Op: "rotate", Path: name, Err: err}
+			}
+			if rewrapped[i], err = seal(wrapper, dataKey, wrapAAD(keyID)); err != nil {
+				return rotated, err
+			}
+		}
+
+		var n int
+		err = fs.retry(ctx, func() error {
+			n = 0
+			tx, err := fs.db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			// Rows changed in the meantime keep what they have now
+			files, err := tx.PrepareContext(ctx, `UPDATE file_metadata SET key_id = ?, data_key = ? WHERE id = ? AND key_id = ? AND data_key = ?`)
+			if err != nil {
+				return err
+			}
+			defer files.Close()
+			blobs, err := tx.PrepareContext(ctx, `UPDATE content_blobs SET key_id = ?, data_key = ? WHERE file_id = ? AND key_id = ? AND data_key = ?`)
+			if err != nil {
+				return err
+			}
+			defer blobs.Close()
+			for i, k := range page {
+				stmt := files
+				if k.digest != nil {
+					stmt = blobs
+				}
+				result, err := stmt.ExecContext(ctx, keyID, rewrapped[i], k.id, k.keyID, k.wrapped)
+				if err != nil {
+					return err
+				}
+				affected, _ := result.RowsAffected()
+				n += int(affected)
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			return rotated, err
+		}
+		rotated += n
+		for _, k := range page {
+			if k.digest == nil {
+				fs.invalidatePath(k.path)
+			}
+		}
+		lastID = page[len(page)-1].id
+	}
+}
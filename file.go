@@ -1,6 +1,9 @@
 package sqlitefs
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"database/sql"
 	"errors"
 	"io"
@@ -8,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,15 +38,65 @@ func (d *dirEntry) Info() (fs.FileInfo, error) {
 
 // SQLiteFile implements the fs.File and fs.ReadDirFile interfaces.
 type SQLiteFile struct {
-	db     *sql.DB
-	path   string
-	offset int64 // current offset for read operations
-	size   int64 // total file size
-	isDir  bool  // whether this is a directory
+	fs      *SQLiteFS
+	db      *sql.DB
+	path    string
+	fileID  int64       // file_metadata id, resolved once at open
+	offset  int64       // current offset for read operations
+	size    int64       // total file size
+	isDir   bool        // whether this is a directory
+	inline  []byte      // content of a file stored inline, nil otherwise
+	codec   Codec       // decompresses the fragments, nil if stored uncompressed
+	aead    cipher.AEAD // decrypts the fragments, nil if stored unencrypted
+	chunked bool        // fragments are content-defined chunks, see locate
+	info    *fileInfo   // info of the version the handle reads, nil for directories
+
+	ownsStmts   bool        // statements were prepared for this handle alone
+	tracked     bool        // counted as an open handle on fileID
+	lastReadEnd int64       // offset right after the previous Read, -1 if none
+	prefetch    *prefetcher // active background prefetch, if any
 }
 
-// NewSQLiteFile creates a new SQLiteFile instance for the given path.
+// writeToBatch is the number of fragments WriteTo loads per query.
+const writeToBatch = 8
+
+var (
+	_ io.ReaderAt = (*SQLiteFile)(nil)
+	_ io.WriterTo = (*SQLiteFile)(nil)
+)
+
+// upgradedDBs holds the pools NewSQLiteFile has upgraded the schema of, so
+// only the first file opened on a pool pays for it.
+var upgradedDBs sync.Map // *sql.DB -> struct{}
+
+// NewSQLiteFile creates a new SQLiteFile instance for the given path. Like
+// NewSQLiteFS, it first upgrades a database created by an older version,
+// once per db.
 func NewSQLiteFile(db *sql.DB, path string) (*SQLiteFile, error) {
+	fsys := &SQLiteFS{db: db, readDB: db, retryPolicy: DefaultRetryPolicy}
+	if _, ok := upgradedDBs.Load(db); !ok {
+		err := fsys.retry(context.Background(), fsys.createTablesIfNeeded)
+		if err != nil {
+			return nil, err
+		}
+		upgradedDBs.Store(db, struct{}{})
+	}
+
+	// The file gets its own statements, prepared as it needs them and
+	// released again by Close
+	fsys.stmts = lazyFileStatements(db)
+
+	file, err := newSQLiteFile(fsys, path)
+	if err != nil {
+		fsys.stmts.close()
+		return nil, err
+	}
+	file.ownsStmts = true
+	return file, nil
+}
+
+// newSQLiteFile opens path using the settings and caches of fsys.
+func newSQLiteFile(fsys *SQLiteFS, path string) (*SQLiteFile, error) {
 	// Check if path is a directory (ends with /)
 	isDir := false
 	if path == "" || path == "/" || (len(path) > 0 && path[len(path)-1] == '/') {
@@ -50,23 +104,71 @@ func NewSQLiteFile(db *sql.DB, path string) (*SQLiteFile, error) {
 	}
 
 	file := &SQLiteFile{
-		db:    db,
-		path:  path,
-		isDir: isDir,
+		fs:          fsys,
+		db:          fsys.readDB,
+		path:        path,
+		isDir:       isDir,
+		lastReadEnd: -1,
 	}
 
-	// Initialize file size if it's not a directory
-	if !isDir {
-		size, err := file.getTotalSize()
+	// Resolve the file id and size once if it's not a directory
+	for !isDir {
+		var gen uint64
+		if fsys.versions != nil {
+			gen = fsys.versions.generation()
+		}
+		meta, err := fsys.statFile(path)
 		if err != nil {
 			return nil, err
 		}
-		file.size = size
+		if !meta.exists {
+			return nil, os.ErrNotExist
+		}
+		if err := file.load(meta); err != nil {
+			return nil, &PathError{Op: "open", Path: path, Err: err}
+		}
+		file.info = &fileInfo{
+			name:     filepath.Base(path),
+			size:     meta.size,
+			modTime:  meta.modTime,
+			mimeType: meta.mimeType,
+			sha256:   meta.sha256,
+		}
+
+		// Pin the version so its fragments outlive a replace or remove.
+		// Inline content is already held by the handle.
+		if meta.inline != nil || fsys.versions == nil {
+			break
+		}
+		if fsys.versions.acquire(meta.id, gen) {
+			file.tracked = true
+			break
+		}
+		// A version was reclaimed meanwhile, possibly this one
 	}
 
 	return file, nil
 }
 
+// load points the handle at the stored content meta describes.
+func (f *SQLiteFile) load(meta fileMeta) error {
+	f.fileID = meta.id
+	f.size = meta.size
+	f.inline = meta.inline
+	f.chunked = meta.chunked
+	f.codec = nil
+	if meta.codec != "" {
+		codec, err := f.fs.codec(meta.codec)
+		if err != nil {
+			return err
+		}
+		f.codec = codec
+	}
+	var err error
+	f.aead, err = f.fs.dataCipher(context.Background(), meta.keyID, meta.dataKey)
+	return err
+}
+
 func (f *SQLiteFile) Read(p []byte) (int, error) {
 	// Return EOF for directory reads
 	if f.isDir {
@@ -78,67 +180,231 @@ func (f *SQLiteFile) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
-	bytesReadTotal := 0
-	for {
-		// Calculate current fragment index and offset within that fragment
-		fragmentIndex := f.offset / fragmentSize
-		internalOffset := f.offset % fragmentSize
-
-		// Determine how many bytes to read from the current fragment
-		readLength := min(fragmentSize-internalOffset, int64(len(p))-int64(bytesReadTotal))
-
-		// If we've reached the end of the file, return what we've read so far
-		if f.offset >= f.size {
-			if bytesReadTotal == 0 {
-				return 0, io.EOF
-			}
-			return bytesReadTotal, nil
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	var err error
+	if f.fs.readAhead > 0 {
+		n, err = f.readSequential(p)
+	} else {
+		n, err = f.readFragments(p, f.offset)
+	}
+	f.offset += int64(n) // Update file offset
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt. It reads len(p) bytes starting at off
+// without using or changing the handle's offset, so several goroutines may
+// call it on the same handle at once.
+func (f *SQLiteFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.isDir {
+		return 0, io.EOF
+	}
+	if off < 0 {
+		return 0, errors.New("sqlitefs: negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.readFragments(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+		if off+int64(n) < f.size {
+			err = io.ErrUnexpectedEOF
 		}
+	}
+	return n, err
+}
 
-		// SQL query to read a substring of the fragment
-		query := `
-			SELECT SUBSTR(fragment, ?, ?) 
-			FROM file_fragments 
-			WHERE file_id = (SELECT id FROM file_metadata WHERE path = ?) 
-			AND fragment_index = ?
-		`
-		row := f.db.QueryRow(query, internalOffset+1, readLength, f.path, fragmentIndex)
-
-		var fragment []byte
-		err := row.Scan(&fragment)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				// If we've read some data, return the count
-				if bytesReadTotal > 0 {
-					return bytesReadTotal, nil
-				}
-				// Otherwise return EOF
-				return 0, io.EOF
+// WriteTo implements io.WriterTo. It streams the file from the current
+// offset to w fragment by fragment, loading a small batch of fragments per
+// query into reused buffers, so memory use stays flat for any file size.
+func (f *SQLiteFile) WriteTo(w io.Writer) (int64, error) {
+	if f.isDir {
+		return 0, nil
+	}
+	f.stopPrefetch()
+
+	var written int64
+	buffers := make([][]byte, writeToBatch)
+	first, start, err := f.locate(f.offset)
+	if err != nil {
+		return 0, err
+	}
+	for f.offset < f.size {
+		// Copy the batch out so no rows stay open while w is written to
+		count := 0
+		err := f.eachFragment(context.Background(), first, first+writeToBatch-1, func(index int64, fragment []byte) bool {
+			if index != first+int64(count) {
+				return false
 			}
-			return bytesReadTotal, err
+			buffers[count] = append(buffers[count][:0], fragment...)
+			count++
+			return true
+		})
+		if err != nil {
+			return written, err
+		}
+		if count == 0 {
+			// Missing fragment, the content ends before its size
+			return written, io.ErrUnexpectedEOF
 		}
 
-		// Copy the read data to buffer p
-		bytesRead := copy(p[bytesReadTotal:], fragment)
-		bytesReadTotal += bytesRead
-		f.offset += int64(bytesRead) // Update file offset
+		for i, fragment := range buffers[:count] {
+			if i > 0 {
+				start = f.fragmentStart(first+int64(i), start, len(buffers[i-1]))
+			}
+			internalOffset := f.offset - start
+			if internalOffset < 0 || internalOffset >= int64(len(fragment)) {
+				return written, io.ErrUnexpectedEOF
+			}
+			chunk := fragment[internalOffset:]
+			chunk = chunk[:min(int64(len(chunk)), f.size-f.offset)]
 
-		// If bytesRead is 0 and this is the last fragment, return what we've read
-		if bytesRead == 0 {
-			if f.offset >= f.size {
-				return bytesReadTotal, nil
+			n, err := w.Write(chunk)
+			written += int64(n)
+			f.offset += int64(n)
+			if err != nil {
+				return written, err
+			}
+			if n < len(chunk) {
+				return written, io.ErrShortWrite
 			}
-			continue // Continue reading the next fragment
 		}
+		start = f.fragmentStart(first+int64(count), start, len(buffers[count-1]))
+		first += int64(count)
+	}
+	f.lastReadEnd = f.offset
 
-		// If we've read all requested data, return the result
-		if bytesReadTotal == len(p) {
-			break
+	return written, nil
+}
+
+// readFragments fills p with file content starting at off. All fragments
+// covering the requested range are fetched with a single query. It returns
+// io.EOF at the end of the file and io.ErrUnexpectedEOF when fragments are
+// missing before it, and only when nothing could be read.
+func (f *SQLiteFile) readFragments(p []byte, off int64) (int, error) {
+	end := min(off+int64(len(p)), f.size)
+	if off >= end {
+		return 0, io.EOF
+	}
+
+	first, start, err := f.locate(off)
+	if err != nil {
+		return 0, err
+	}
+	last, _, err := f.locate(end - 1)
+	if err != nil {
+		return 0, err
+	}
+
+	bytesReadTotal := 0
+	want := int(end - off)
+	next, prevLen := first, 0
+	err = f.eachFragment(context.Background(), first, last, func(index int64, fragment []byte) bool {
+		// Stop at a missing fragment rather than returning misplaced data
+		if index != next {
+			return false
+		}
+		if index > first {
+			start = f.fragmentStart(index, start, prevLen)
+		}
+		next, prevLen = index+1, len(fragment)
+
+		pos := off + int64(bytesReadTotal)
+		internalOffset := pos - start
+		if internalOffset < 0 || internalOffset >= int64(len(fragment)) {
+			return false
 		}
+		bytesReadTotal += copy(p[bytesReadTotal:want], fragment[internalOffset:])
+		return bytesReadTotal < want
+	})
+	if err != nil {
+		return bytesReadTotal, err
+	}
+
+	if bytesReadTotal == 0 {
+		// off is before the end, so the content was lost
+		return 0, io.ErrUnexpectedEOF
 	}
 	return bytesReadTotal, nil
 }
 
+// eachFragment calls fn for the stored fragments first..last in index order
+// until fn returns false. Fragments are served from the shared cache when
+// possible; the remainder is loaded with a single range query. The slice
+// passed to fn is only valid during the call.
+func (f *SQLiteFile) eachFragment(ctx context.Context, first, last int64, fn func(index int64, fragment []byte) bool) error {
+	// Inline content never exceeds a fragment and acts as fragment 0
+	if f.inline != nil {
+		if first == 0 {
+			fn(0, f.inline)
+		}
+		return nil
+	}
+
+	index := first
+	if f.fs.cache != nil {
+		for ; index <= last; index++ {
+			fragment, ok := f.fs.cache.get(f.fileID, index)
+			if !ok {
+				break
+			}
+			if !fn(index, fragment) {
+				return nil
+			}
+		}
+		if index > last {
+			return nil
+		}
+	}
+
+	// A retry resumes after the last fragment handed to fn
+	return f.fs.retry(ctx, func() error {
+		stmt, err := f.fs.stmts.get(&f.fs.stmts.fragmentRange)
+		if err != nil {
+			return err
+		}
+		rows, err := stmt.QueryContext(ctx, f.fileID, index, last)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var fragmentIndex int64
+			var fragment sql.RawBytes
+			var crc sql.NullInt64
+			if err := rows.Scan(&fragmentIndex, &fragment, &crc); err != nil {
+				return err
+			}
+			if err := verifyFragment(f.path, f.fileID, fragmentIndex, fragment, crc); err != nil {
+				return err
+			}
+
+			// The cache keeps fragments as they are read, decoded
+			data, err := decodeFragment(f.aead, f.codec, f.fileID, fragmentIndex, fragment)
+			if err != nil {
+				return &PathError{Op: "read", Path: f.path, Err: err}
+			}
+			if f.aead == nil && f.codec == nil && f.fs.cache != nil {
+				data = bytes.Clone(data)
+			}
+			if f.fs.cache != nil {
+				f.fs.cache.put(f.fileID, fragmentIndex, data)
+			}
+			index = fragmentIndex + 1
+			if !fn(fragmentIndex, data) {
+				return nil
+			}
+		}
+		return rows.Err()
+	})
+}
+
 func (f *SQLiteFile) Seek(offset int64, whence int) (int64, error) {
 	var newOffset int64
 	switch whence {
@@ -147,11 +413,8 @@ func (f *SQLiteFile) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		newOffset = f.offset + offset
 	case io.SeekEnd:
-		totalSize, err := f.getTotalSize()
-		if err != nil {
-			return 0, err
-		}
-		newOffset = totalSize + offset
+		// The size of the pinned version, whatever happened to the path
+		newOffset = f.size + offset
 	default:
 		return 0, errors.New("sqlitefs: invalid whence")
 	}
@@ -160,6 +423,12 @@ func (f *SQLiteFile) Seek(offset int64, whence int) (int64, error) {
 		return 0, errors.New("sqlitefs: negative position")
 	}
 
+	// Moving the position ends sequential access
+	if newOffset != f.offset {
+		f.stopPrefetch()
+		f.lastReadEnd = -1
+	}
+
 	f.offset = newOffset
 	return newOffset, nil
 }
@@ -171,152 +440,15 @@ func (f *SQLiteFile) ReadDir(n int) ([]fs.DirEntry, error) {
 		return nil, errors.New("not a directory")
 	}
 
-	var rows *sql.Rows
-	var err error
-
-	// Handle root directory specially
-	if f.path == "" || f.path == "/" {
-		// Root directory - list all files
-		query := `SELECT path, type FROM file_metadata`
-		rows, err = f.db.Query(query)
-	} else {
-		// Ensure path ends with / for directory queries
-		dirPath := f.path
-		if !strings.HasSuffix(dirPath, "/") {
-			dirPath += "/"
-		}
-		// Query to get files in the directory
-		query := `
-			SELECT path, type 
-			FROM file_metadata 
-			WHERE path LIKE ? AND path != ?
-		`
-		rows, err = f.db.Query(query, dirPath+"%", dirPath)
-	}
-
+	infos, err := f.fs.listDir(f.path, n)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var entries []fs.DirEntry
-	var seenPaths = make(map[string]bool)
-	var path, fileType string
-
-	for rows.Next() {
-		err := rows.Scan(&path, &fileType)
-		if err != nil {
-			return nil, err
-		}
-
-		// For root directory, handle paths differently
-		var childName string
-		var childPath string
-		var isSubDir bool
-
-		if f.path == "" || f.path == "/" {
-			// Root directory - extract first path component
-			parts := strings.SplitN(path, "/", 2)
-			childName = parts[0]
-			isSubDir = len(parts) > 1 || strings.HasSuffix(path, "/")
-			childPath = childName
-			if isSubDir && !strings.HasSuffix(childPath, "/") {
-				childPath += "/"
-			}
-		} else {
-			// Get directory path
-			dirPath := f.path
-			if !strings.HasSuffix(dirPath, "/") {
-				dirPath += "/"
-			}
-
-			// Skip the directory itself
-			if path == dirPath {
-				continue
-			}
-
-			// Extract the immediate child name
-			relPath := strings.TrimPrefix(path, dirPath)
-			parts := strings.SplitN(relPath, "/", 2)
-			childName = parts[0]
-
-			// If this is a subdirectory entry, add a trailing slash
-			isSubDir = len(parts) > 1 || strings.HasSuffix(path, "/")
-			childPath = dirPath + childName
-			if isSubDir && !strings.HasSuffix(childPath, "/") {
-				childPath += "/"
-			}
-		}
-
-		// Skip if we've already seen this immediate child
-		if seenPaths[childPath] {
-			continue
-		}
-		seenPaths[childPath] = true
-
-		// Create FileInfo for this child - use original name, not modified path
-		// The childPath might have "/" appended for directories, but we want the clean name
-		cleanName := childName
-		if isSubDir && strings.HasSuffix(cleanName, "/") {
-			cleanName = strings.TrimSuffix(cleanName, "/")
-		}
-
-		// Create file info with proper directory flag
-		fileInfo := &fileInfo{
-			name:    cleanName,
-			size:    0, // Size will be set for files
-			modTime: time.Now(),
-			isDir:   isSubDir,
-		}
 
-		// If it's a file, get its size
-		if !isSubDir {
-			// Get file size from database
-			var size sql.NullInt64
-			query := `
-				SELECT SUM(LENGTH(fragment)) 
-				FROM file_fragments 
-				WHERE file_id = (SELECT id FROM file_metadata WHERE path = ?)
-			`
-			err = f.db.QueryRow(query, path).Scan(&size)
-			if err == nil && size.Valid {
-				fileInfo.size = size.Int64
-			}
-		}
-
-		// Convert FileInfo to DirEntry
-		entries = append(entries, &dirEntry{info: fileInfo})
-
-		if n > 0 && len(entries) >= n {
-			break
-		}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, &dirEntry{info: info})
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	// If no entries were found, check if the directory exists
-	if len(entries) == 0 {
-		var exists bool
-		checkPath := f.path
-		if checkPath != "" && checkPath != "/" {
-			if !strings.HasSuffix(checkPath, "/") {
-				checkPath += "/"
-			}
-			err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ?)", checkPath+"%").Scan(&exists)
-		} else {
-			// For root, check if any files exist
-			err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata)").Scan(&exists)
-		}
-		if err != nil {
-			return nil, err
-		}
-		if !exists {
-			return nil, errors.New("directory not found")
-		}
-	}
-
 	return entries, nil
 }
 
@@ -327,133 +459,37 @@ func (f *SQLiteFile) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, errors.New("not a directory")
 	}
 
-	var rows *sql.Rows
-	var err error
-	var dirPath string
-
-	// Handle root directory specially
-	if f.path == "" || f.path == "/" {
-		// Root directory - list all files
-		query := `SELECT path, type FROM file_metadata`
-		rows, err = f.db.Query(query)
-		dirPath = ""
-	} else {
-		// Ensure path ends with / for directory queries
-		dirPath = f.path
-		if !strings.HasSuffix(dirPath, "/") {
-			dirPath += "/"
-		}
-		// Query to get files in the directory
-		query := `
-			SELECT path, type 
-			FROM file_metadata 
-			WHERE path LIKE ? AND path != ?
-		`
-		rows, err = f.db.Query(query, dirPath+"%", dirPath)
-	}
-
+	infos, err := f.fs.listDir(f.path, count)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var fileInfos []os.FileInfo
-	var seenPaths = make(map[string]bool)
-	var path, fileType string
-
-	for rows.Next() {
-		err := rows.Scan(&path, &fileType)
-		if err != nil {
-			return nil, err
-		}
-
-		// For root directory, handle paths differently
-		var childName string
-		var childPath string
-		var isSubDir bool
-
-		if f.path == "" || f.path == "/" {
-			// Root directory - extract first path component
-			parts := strings.SplitN(path, "/", 2)
-			childName = parts[0]
-			isSubDir = len(parts) > 1 || strings.HasSuffix(path, "/")
-			childPath = childName
-			if isSubDir && !strings.HasSuffix(childPath, "/") {
-				childPath += "/"
-			}
-		} else {
-			// Get directory path
-			dirPath := f.path
-			if !strings.HasSuffix(dirPath, "/") {
-				dirPath += "/"
-			}
-
-			// Skip the directory itself
-			if path == dirPath {
-				continue
-			}
-
-			// Extract the immediate child name
-			relPath := strings.TrimPrefix(path, dirPath)
-			parts := strings.SplitN(relPath, "/", 2)
-			childName = parts[0]
-
-			// If this is a subdirectory entry, add a trailing slash
-			isSubDir = len(parts) > 1 || strings.HasSuffix(path, "/")
-			childPath = dirPath + childName
-			if isSubDir && !strings.HasSuffix(childPath, "/") {
-				childPath += "/"
-			}
-		}
-
-		// Skip if we've already seen this immediate child
-		if seenPaths[childPath] {
-			continue
-		}
-		seenPaths[childPath] = true
-
-		// Create FileInfo for this child
-		fileInfo, err := f.createFileInfo(childPath)
-		if err != nil {
-			return nil, err
-		}
-
-		fileInfos = append(fileInfos, fileInfo)
-
-		if count > 0 && len(fileInfos) >= count {
-			break
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
 
-	// If no entries were found, check if the directory exists
-	if len(fileInfos) == 0 {
-		var exists bool
-		if dirPath == "" {
-			// For root, check if any files exist
-			err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata)").Scan(&exists)
-		} else {
-			err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ?)", dirPath+"%").Scan(&exists)
-		}
-		if err != nil {
-			return nil, err
-		}
-		if !exists {
-			return nil, errors.New("directory not found")
-		}
+	fileInfos := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		fileInfos = append(fileInfos, info)
 	}
-
 	return fileInfos, nil
 }
 
 func (f *SQLiteFile) Stat() (os.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
 	return f.createFileInfo(f.path)
 }
 
 func (f *SQLiteFile) Close() error {
+	f.stopPrefetch()
+	if f.tracked {
+		f.tracked = false
+		if err := f.fs.releaseVersion(f.fileID); err != nil {
+			return err
+		}
+	}
+	if f.ownsStmts {
+		f.ownsStmts = false
+		return f.fs.stmts.close()
+	}
 	return nil
 }
 
@@ -463,63 +499,41 @@ func (f *SQLiteFile) createFileInfo(path string) (os.FileInfo, error) {
 
 	var size int64
 	var modTime time.Time = time.Now() // Use current time as default
+	var mimeType string
+	var sha256 []byte
 
 	if !isDir {
-		// Get file size
-		query := `
-			SELECT SUM(LENGTH(fragment)) 
-			FROM file_fragments 
-			WHERE file_id = (SELECT id FROM file_metadata WHERE path = ?)
-		`
-		err := f.db.QueryRow(query, path).Scan(&size)
+		meta, err := f.fs.statFile(path)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// If no fragments found, check if the file exists in metadata
-				var exists bool
-				err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path = ?)", path).Scan(&exists)
-				if err != nil {
-					return nil, err
-				}
-				if !exists {
-					return nil, os.ErrNotExist
-				}
-				// File exists but has no content
-				size = 0
-			} else {
-				return nil, err
-			}
+			return nil, err
 		}
-	} else {
+		if !meta.exists {
+			return nil, os.ErrNotExist
+		}
+		size = meta.size
+		modTime = meta.modTime
+		mimeType = meta.mimeType
+		sha256 = meta.sha256
+	} else if path != "" && path != "/" {
 		// For directories, check if they exist by looking for files with this prefix
-		var exists bool
-
-		if path == "" || path == "/" {
-			// Root directory - check if any files exist
-			err := f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata)").Scan(&exists)
-			if err != nil {
-				return nil, err
-			}
-			// Root always exists even if empty
-			exists = true
-		} else {
-			dirPath := path
-			if !strings.HasSuffix(dirPath, "/") {
-				dirPath += "/"
-			}
+		// (root always exists even if empty)
+		dirPath := path
+		if !strings.HasSuffix(dirPath, "/") {
+			dirPath += "/"
+		}
 
-			err := f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ?)", dirPath+"%").Scan(&exists)
+		exists, err := f.fs.dirExists(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			// Also check if this exact path exists in metadata (empty directory)
+			meta, err := f.fs.statFile(path)
 			if err != nil {
 				return nil, err
 			}
-			if !exists {
-				// Also check if this exact path exists in metadata (empty directory)
-				err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path = ?)", path).Scan(&exists)
-				if err != nil {
-					return nil, err
-				}
-				if !exists {
-					return nil, os.ErrNotExist
-				}
+			if !meta.exists {
+				return nil, os.ErrNotExist
 			}
 		}
 	}
@@ -534,47 +548,11 @@ func (f *SQLiteFile) createFileInfo(path string) (os.FileInfo, error) {
 	}
 
 	return &fileInfo{
-		name:    name,
-		size:    size,
-		modTime: modTime,
-		isDir:   isDir,
+		name:     name,
+		size:     size,
+		modTime:  modTime,
+		isDir:    isDir,
+		mimeType: mimeType,
+		sha256:   sha256,
 	}, nil
 }
-
-func (f *SQLiteFile) getTotalSize() (int64, error) {
-	// Get the number of fragments and the size of the last fragment
-	query := `
-	SELECT COUNT(*), COALESCE(LENGTH(fragment), 0)
-	FROM file_fragments
-	WHERE file_id = (SELECT id FROM file_metadata WHERE path = ?)
-	ORDER BY fragment_index DESC
-	LIMIT 1;
-	`
-
-	var count, lastFragmentSize int
-	err := f.db.QueryRow(query, f.path).Scan(&count, &lastFragmentSize)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// Check if the file exists in metadata but has no fragments
-			var exists bool
-			err = f.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path = ?)", f.path).Scan(&exists)
-			if err != nil {
-				return 0, err
-			}
-			if exists {
-				// File exists but has no content
-				return 0, nil
-			}
-			return 0, os.ErrNotExist
-		}
-		return 0, err
-	}
-
-	if count == 0 {
-		return 0, nil
-	}
-
-	// Calculate the total file size
-	totalSize := int64((count-1)*fragmentSize + lastFragmentSize)
-	return totalSize, nil
-}
@@ -5,11 +5,28 @@ import (
 	"time"
 )
 
+// MIMETyper is implemented by the fs.FileInfo of stored files. MIMEType
+// returns the type detected when the file was written, or "" when it is not
+// known, as for directories.
+type MIMETyper interface {
+	MIMEType() string
+}
+
+// Hasher is implemented by the fs.FileInfo of stored files. SHA256 returns
+// the digest recorded when the file was written, or nil when it is not
+// known: for directories and for files stored by versions that did not
+// record digests yet, see SQLiteFS.Hash.
+type Hasher interface {
+	SHA256() []byte
+}
+
 type fileInfo struct {
-	name    string
-	size    int64
-	modTime time.Time
-	isDir   bool
+	name     string
+	size     int64
+	modTime  time.Time
+	isDir    bool
+	mimeType string
+	sha256   []byte
 }
 
 func (fi *fileInfo) Name() string { return fi.name }
@@ -23,3 +40,5 @@ func (fi *fileInfo) Mode() os.FileMode {
 func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
 func (fi *fileInfo) IsDir() bool        { return fi.isDir }
 func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) MIMEType() string   { return fi.mimeType }
+func (fi *fileInfo) SHA256() []byte     { return fi.sha256 }
@@ -0,0 +1,619 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// lostAndFound is the directory Repair moves files to that cannot be fixed
+// in place.
+const lostAndFound = "lost+found/"
+
+// ProblemKind classifies what Check found wrong.
+type ProblemKind int
+
+const (
+	// ProblemOrphanFragments: fragments of a file id that is neither stored
+	// in file_metadata or content_blobs nor an upload or version awaiting
+	// reclaim.
+	ProblemOrphanFragments ProblemKind = iota
+	// ProblemGap: a fragment index is missing; Index is the first one.
+	ProblemGap
+	// ProblemFragmentSize: a fragment other than the last one does not have
+	// the full fragment size, which breaks offset arithmetic, or a chunk of
+	// a file written with WithChunking does not start at its stored offset.
+	ProblemFragmentSize
+	// ProblemCorrupt: a fragment fails its CRC-32C.
+	ProblemCorrupt
+	// ProblemHashMismatch: the content does not match the stored SHA-256.
+	ProblemHashMismatch
+	// ProblemMalformedPath: the path cannot be opened through fs.FS.
+	ProblemMalformedPath
+	// ProblemDuplicatePath: the path names the same file as another one,
+	// such as "/a" next to "a".
+	ProblemDuplicatePath
+	// ProblemPathConflict: a file has the name of a directory.
+	ProblemPathConflict
+	// ProblemSizeMismatch: the content is not as long as the stored size.
+	ProblemSizeMismatch
+	// ProblemBlobRefs: the reference count of a deduplicated fragment
+	// differs from the number of fragments referring to it; Blob names it.
+	ProblemBlobRefs
+)
+
+var problemNames = [...]string{
+	ProblemOrphanFragments: "orphan fragments",
+	ProblemGap:             "missing fragment",
+	ProblemFragmentSize:    "fragment size",
+	ProblemCorrupt:         "corrupt fragment",
+	ProblemHashMismatch:    "hash mismatch",
+	ProblemMalformedPath:   "malformed path",
+	ProblemDuplicatePath:   "duplicate path",
+	ProblemPathConflict:    "path conflict",
+	ProblemSizeMismatch:    "size mismatch",
+	ProblemBlobRefs:        "blob references",
+}
+
+func (k ProblemKind) String() string {
+	if k >= 0 && int(k) < len(problemNames) {
+		return problemNames[k]
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem is one inconsistency found by Check.
+type Problem struct {
+	Kind   ProblemKind
+	Path   string // "" for orphan fragments and blobs
+	FileID int64
+	Index  int64  // fragment index, -1 if the problem is not about one fragment
+	Blob   []byte // hash of the deduplicated fragment or digest of the blob, nil unless the problem is about one
+	Detail string // human readable description
+	Action string // what Repair did about it, "" for Check
+
+	keep        int64 // bytes of content before a gap, kept by Repair
+	contentBlob bool  // the problem is about the content of the blob with digest Blob
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: file %d %q: %s", p.Kind, p.FileID, p.Path, p.Detail)
+	if p.Action != "" {
+		s += " (" + p.Action + ")"
+	}
+	return s
+}
+
+// CheckReport is the result of Check and Repair.
+type CheckReport struct {
+	Files     int64 // files checked
+	Blobs     int64 // blobs from PutBlob checked
+	Fragments int64 // fragments checked
+	Problems  []Problem
+}
+
+// Check validates the whole store: every fragment is read and verified
+// against its checksum, fragment sequences are checked for gaps and
+// misplaced short fragments, the content of files and blobs is compared
+// with the stored size and SHA-256, the reference counts of deduplicated
+// fragments are recounted,
+// and paths are checked for forms fs.FS cannot open or that clash with
+// other paths. Nothing is changed. Uploads in progress and versions waiting
+// to be reclaimed are not reported, nor is the content of files Repair
+// already moved to lost+found.
+func (fs *SQLiteFS) Check(ctx context.Context) (CheckReport, error) {
+	var report CheckReport
+
+	// Reference counts come first so Repair fixes them before deleting
+	// anything that releases references
+	blobs, err := fs.checkBlobs(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Problems = append(report.Problems, blobs...)
+
+	orphans, err := fs.checkOrphans(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Problems = append(report.Problems, orphans...)
+
+	contentBlobs, err := fs.checkContentBlobs(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, blob := range contentBlobs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		problems, fragments, err := fs.checkContent(ctx, blob)
+		if err != nil {
+			return report, err
+		}
+		for i := range problems {
+			problems[i].Blob = blob.sha256
+			problems[i].contentBlob = true
+		}
+		report.Blobs++
+		report.Fragments += fragments
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	files, err := fs.checkFiles(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Problems = append(report.Problems, checkPaths(files)...)
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if strings.HasPrefix(file.path, lostAndFound) {
+			continue
+		}
+		problems, fragments, err := fs.checkContent(ctx, file)
+		if err != nil {
+			return report, err
+		}
+		report.Files++
+		report.Fragments += fragments
+		report.Problems = append(report.Problems, problems...)
+	}
+	return report, nil
+}
+
+// Repair runs Check and fixes what it finds. Reference counts are corrected,
+// orphan fragments and unreferenced blobs are deleted, files with a missing
+// fragment are truncated before it, and files that cannot be fixed in place,
+// including those with malformed or clashing paths, are moved to
+// lost+found/<file id>-<name>. Damaged blobs are removed like with
+// RemoveBlob. Each problem's Action tells what was done.
+func (fs *SQLiteFS) Repair(ctx context.Context) (CheckReport, error) {
+	report, err := fs.Check(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	quarantined := make(map[int64]string)
+	for i := range report.Problems {
+		p := &report.Problems[i]
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if action, ok := quarantined[p.FileID]; ok {
+			p.Action = action
+			continue
+		}
+
+		switch {
+		case p.contentBlob:
+			// A blob must match its digest, so nothing short of the whole
+			// content can stay
+			err = fs.RemoveBlob(p.Blob)
+			if errors.Is(err, iofs.ErrNotExist) {
+				err = nil
+			}
+			quarantined[p.FileID] = "blob removed"
+			p.Action = "blob removed"
+		case p.Kind == ProblemBlobRefs:
+			var deleted bool
+			deleted, err = fs.fixBlobRefs(p.Blob)
+			p.Action = "reference count corrected"
+			if deleted {
+				p.Action = "deleted"
+			}
+		case p.Kind == ProblemOrphanFragments:
+			err = fs.deleteOrphan(p.FileID)
+			p.Action = "deleted"
+		case p.Kind == ProblemGap:
+			err = fs.truncateFile(p.FileID, p.Path, p.Index, p.keep)
+			p.Action = fmt.Sprintf("truncated to %d fragments", p.Index)
+		default:
+			dest := lostAndFound + fmt.Sprintf("%d-%s", p.FileID, lostName(p.Path))
+			err = fs.movePath(p.FileID, p.Path, dest)
+			quarantined[p.FileID] = "moved to " + dest
+			p.Action = "moved to " + dest
+		}
+		if err != nil {
+			p.Action = ""
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// checkedFile is a file_metadata row as seen by Check, or a content_blobs
+// row with the digest in sha256 and no path.
+type checkedFile struct {
+	id      int64
+	path    string
+	inline  bool
+	sha256  []byte
+	codec   sql.NullString
+	size    sql.NullInt64
+	keyID   sql.NullString
+	dataKey []byte
+	chunked bool
+}
+
+// checkOrphans finds fragments nothing refers to. The queries of Check and
+// Repair are rare enough to go without prepared statements.
+func (fs *SQLiteFS) checkOrphans(ctx context.Context) ([]Problem, error) {
+	var problems []Problem
+	err := fs.retry(ctx, func() error {
+		problems = problems[:0]
+		rows, err := fs.readDB.QueryContext(ctx, `
+			SELECT file_id, COUNT(*)
+			FROM file_fragments
+			WHERE file_id NOT IN (SELECT id FROM file_metadata)
+			AND file_id NOT IN (SELECT file_id FROM file_reclaim)
+			AND file_id NOT IN (SELECT file_id FROM content_blobs)
+			GROUP BY file_id
+			ORDER BY file_id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var fileID, count int64
+			if err := rows.Scan(&fileID, &count); err != nil {
+				return err
+			}
+			problems = append(problems, Problem{
+				Kind:   ProblemOrphanFragments,
+				FileID: fileID,
+				Index:  -1,
+				Detail: fmt.Sprintf("%d fragments without a file", count),
+			})
+		}
+		return rows.Err()
+	})
+	return problems, err
+}
+
+// checkFiles lists every stored file in path order.
+func (fs *SQLiteFS) checkFiles(ctx context.Context) ([]checkedFile, error) {
+	var files []checkedFile
+	err := fs.retry(ctx, func() error {
+		files = files[:0]
+		rows, err := fs.readDB.QueryContext(ctx, `SELECT id, path, data IS NOT NULL, sha256, codec, size, key_id, data_key, chunked IS NOT NULL FROM file_metadata ORDER BY path`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var file checkedFile
+			if err := rows.Scan(&file.id, &file.path, &file.inline, &file.sha256, &file.codec, &file.size, &file.keyID, &file.dataKey, &file.chunked); err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		return rows.Err()
+	})
+	return files, err
+}
+
+// checkContentBlobs lists every blob stored by PutBlob as a file without a
+// path, in digest order.
+func (fs *SQLiteFS) checkContentBlobs(ctx context.Context) ([]checkedFile, error) {
+	var blobs []checkedFile
+	err := fs.retry(ctx, func() error {
+		blobs = blobs[:0]
+		rows, err := fs.readDB.QueryContext(ctx, `SELECT file_id, digest, codec, size, key_id, data_key, chunked IS NOT NULL FROM content_blobs ORDER BY digest`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var blob checkedFile
+			if err := rows.Scan(&blob.id, &blob.sha256, &blob.codec, &blob.size, &blob.keyID, &blob.dataKey, &blob.chunked); err != nil {
+				return err
+			}
+			blobs = append(blobs, blob)
+		}
+		return rows.Err()
+	})
+	return blobs, err
+}
+
+// checkPaths reports paths that fs.FS cannot open, that normalize to the
+// same path as another one, or that name a file where a directory is.
+func checkPaths(files []checkedFile) []Problem {
+	var problems []Problem
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if validStoredPath(file.path) {
+			seen[file.path] = true
+		}
+	}
+
+	for i, file := range files {
+		problem := Problem{Path: file.path, FileID: file.id, Index: -1}
+		switch {
+		case !validStoredPath(file.path):
+			clean := cleanStoredPath(file.path)
+			if seen[clean] {
+				problem.Kind = ProblemDuplicatePath
+				problem.Detail = fmt.Sprintf("same file as %q", clean)
+			} else {
+				problem.Kind = ProblemMalformedPath
+				problem.Detail = "not a valid fs.FS path"
+			}
+			seen[clean] = true
+		case !strings.HasSuffix(file.path, "/") && hasDirectory(files[i+1:], file.path+"/"):
+			problem.Kind = ProblemPathConflict
+			problem.Detail = "a directory of the same name exists"
+		default:
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// hasDirectory reports whether any of the sorted files lives under prefix.
+// Names like "a-b" and "a.b" sort between "a" and "a/", so the contents of a
+// directory do not necessarily follow a file of the same name directly.
+func hasDirectory(files []checkedFile, prefix string) bool {
+	i := sort.Search(len(files), func(i int) bool { return files[i].path >= prefix })
+	return i < len(files) && strings.HasPrefix(files[i].path, prefix)
+}
+
+// validStoredPath reports whether a stored path can be opened through
+// fs.FS. Explicitly stored directories end with a slash.
+func validStoredPath(p string) bool {
+	p = strings.TrimSuffix(p, "/")
+	return p != "." && iofs.ValidPath(p)
+}
+
+// cleanStoredPath returns the form a malformed path was probably meant to
+// have.
+func cleanStoredPath(p string) string {
+	clean := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if strings.HasSuffix(p, "/") && clean != "" {
+		clean += "/"
+	}
+	return clean
+}
+
+// lostName turns a path into a single name usable below lost+found.
+func lostName(p string) string {
+	name := baseName(cleanStoredPath(p))
+	if name == "" || !iofs.ValidPath(name) {
+		return "unnamed"
+	}
+	return name
+}
+
+// checkContent reads a file's fragments and verifies their sequence,
+// checksums, sizes or chunk offsets and, if nothing else is wrong, the
+// stored digest.
+func (fs *SQLiteFS) checkContent(ctx context.Context, file checkedFile) ([]Problem, int64, error) {
+	if file.inline {
+		if file.sha256 == nil {
+			return nil, 0, nil
+		}
+		var data []byte
+		err := fs.retry(ctx, func() error {
+			return fs.readDB.QueryRowContext(ctx, `SELECT data FROM file_metadata WHERE id = ?`, file.id).Scan(&data)
+		})
+		if err == sql.ErrNoRows {
+			// Replaced or removed since it was listed
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], file.sha256) {
+			return []Problem{hashMismatch(file, sum[:])}, 0, nil
+		}
+		return nil, 0, nil
+	}
+
+	var codec Codec
+	if file.codec.Valid {
+		var err error
+		if codec, err = fs.codec(file.codec.String); err != nil {
+			return nil, 0, &PathError{Op: "check", Path: file.path, Err: err}
+		}
+	}
+	aead, err := fs.dataCipher(ctx, file.keyID.String, file.dataKey)
+	if err != nil {
+		return nil, 0, &PathError{Op: "check", Path: file.path, Err: err}
+	}
+
+	var problems []Problem
+	var fragments, size int64
+	var sum []byte
+	err = fs.retry(ctx, func() error {
+		problems, fragments, size = problems[:0], 0, 0
+		h := sha256.New()
+		rows, err := fs.readDB.QueryContext(ctx, `
+			SELECT f.fragment_index, COALESCE(b.fragment, f.fragment), f.crc32c, f.byte_offset
+			FROM file_fragments f
+			LEFT JOIN fragment_blobs b ON b.hash = f.blob
+			WHERE f.file_id = ?
+			ORDER BY f.fragment_index`, file.id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var shortIndex int64 = -1 // last fragment seen shorter than fragmentSize
+		lost := false             // the length of the previous chunk is unknown
+		for rows.Next() {
+			var index int64
+			var fragment sql.RawBytes
+			var crc, offset sql.NullInt64
+			if err := rows.Scan(&index, &fragment, &crc, &offset); err != nil {
+				return err
+			}
+			if index != fragments {
+				// Nothing after a gap is at its offset; stop here
+				keep := fragments * fragmentSize
+				if file.chunked {
+					keep = size
+				}
+				problems = append(problems, Problem{
+					Kind: ProblemGap, Path: file.path, FileID: file.id, Index: fragments,
+					Detail: fmt.Sprintf("fragment %d is missing", fragments),
+					keep:   keep,
+				})
+				return nil
+			}
+			fragments++
+			if file.chunked && lost && offset.Valid {
+				// Chunks after a corrupt one are checked against its
+				// recorded end
+				size, lost = offset.Int64, false
+			} else if file.chunked {
+				if !offset.Valid || offset.Int64 != size {
+					detail := fmt.Sprintf("chunk %d starts at %d but is stored at %d", index, size, offset.Int64)
+					if !offset.Valid {
+						detail = fmt.Sprintf("chunk %d has no stored offset", index)
+					}
+					problems = append(problems, Problem{
+						Kind: ProblemFragmentSize, Path: file.path, FileID: file.id, Index: index,
+						Detail: detail,
+					})
+				}
+			}
+			if err := verifyFragment(file.path, file.id, index, fragment, crc); err != nil {
+				problems = append(problems, Problem{
+					Kind: ProblemCorrupt, Path: file.path, FileID: file.id, Index: index,
+					Detail: err.Error(),
+				})
+				lost = true
+				continue
+			}
+			content, err := decodeFragment(aead, codec, file.id, index, fragment)
+			if err != nil {
+				problems = append(problems, Problem{
+					Kind: ProblemCorrupt, Path: file.path, FileID: file.id, Index: index,
+					Detail: err.Error(),
+				})
+				lost = true
+				continue
+			}
+			size += int64(len(content))
+			h.Write(content)
+			if file.chunked {
+				continue
+			}
+
+			if shortIndex >= 0 {
+				problems = append(problems, Problem{
+					Kind: ProblemFragmentSize, Path: file.path, FileID: file.id, Index: shortIndex,
+					Detail: fmt.Sprintf("fragment %d is not the last one but is shorter than %d bytes", shortIndex, fragmentSize),
+				})
+				shortIndex = -1
+			}
+			if len(content) > fragmentSize {
+				problems = append(problems, Problem{
+					Kind: ProblemFragmentSize, Path: file.path, FileID: file.id, Index: index,
+					Detail: fmt.Sprintf("fragment %d is longer than %d bytes", index, fragmentSize),
+				})
+			} else if len(content) < fragmentSize {
+				shortIndex = index
+			}
+		}
+		sum = h.Sum(nil)
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case len(problems) > 0:
+	case file.size.Valid && size != file.size.Int64:
+		problems = append(problems, Problem{
+			Kind: ProblemSizeMismatch, Path: file.path, FileID: file.id, Index: -1,
+			Detail: fmt.Sprintf("content has %d bytes, stored size is %d", size, file.size.Int64),
+		})
+	case file.sha256 != nil && !bytes.Equal(sum, file.sha256):
+		problems = append(problems, hashMismatch(file, sum))
+	}
+	return problems, fragments, nil
+}
+
+func hashMismatch(file checkedFile, sum []byte) Problem {
+	return Problem{
+		Kind: ProblemHashMismatch, Path: file.path, FileID: file.id, Index: -1,
+		Detail: fmt.Sprintf("content has sha256 %x, stored %x", sum, file.sha256),
+	}
+}
+
+// deleteOrphan deletes the fragments of a file id, provided it is still
+// not referenced by anything.
+func (fs *SQLiteFS) deleteOrphan(fileID int64) error {
+	err := fs.retry(context.Background(), func() error {
+		_, err := fs.db.Exec(`
+			DELETE FROM file_fragments
+			WHERE file_id = ?1
+			AND NOT EXISTS (SELECT 1 FROM file_metadata WHERE id = ?1)
+			AND NOT EXISTS (SELECT 1 FROM file_reclaim WHERE file_id = ?1)
+			AND NOT EXISTS (SELECT 1 FROM content_blobs WHERE file_id = ?1)`, fileID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fs.invalidateFile(fileID)
+	return nil
+}
+
+// truncateFile drops the fragments from index on and stores size, the
+// bytes Check counted before the gap; the next Check reports it if that is
+// wrong. The stored digest no longer applies and is cleared, so Hash
+// computes the new one.
+func (fs *SQLiteFS) truncateFile(fileID int64, path string, index, size int64) error {
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`DELETE FROM file_fragments WHERE file_id = ? AND fragment_index >= ?`, fileID, index)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE file_metadata SET sha256 = NULL, size = ? WHERE id = ?`, size, fileID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	fs.invalidateFile(fileID)
+	fs.invalidatePath(path)
+	return nil
+}
+
+// movePath gives a file a new path without touching its content.
+func (fs *SQLiteFS) movePath(fileID int64, from, to string) error {
+	err := fs.retry(context.Background(), func() error {
+		_, err := fs.db.Exec(`UPDATE file_metadata SET path = ? WHERE id = ?`, to, fileID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fs.invalidatePath(from)
+	fs.invalidatePath(to)
+	return nil
+}
@@ -0,0 +1,51 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"strings"
+)
+
+// Hash returns the SHA-256 digest of the file at path. Writers record it
+// while streaming the content, so normally no content is read. Files stored
+// by versions that did not record digests are hashed once and their digest
+// is saved for later calls.
+func (fs *SQLiteFS) Hash(path string) ([]byte, error) {
+	path = strings.TrimPrefix(path, "/")
+	meta, err := fs.statFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !meta.exists {
+		return nil, &PathError{Op: "hash", Path: path, Err: os.ErrNotExist}
+	}
+	if meta.sha256 != nil {
+		return bytes.Clone(meta.sha256), nil
+	}
+
+	file, err := newSQLiteFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	// Only fills in the digest if the version read is still unhashed
+	err = fs.retry(context.Background(), func() error {
+		_, err := fs.stmts.setHash.Exec(sum, file.fileID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.invalidatePath(path)
+	return sum, nil
+}
@@ -0,0 +1,133 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// defaultScrubRate is the number of fragment bytes Scrub reads per second
+// unless WithScrubRate says otherwise.
+const defaultScrubRate = 32 << 20
+
+// scrubPageSize is the number of fragments Scrub loads per query.
+const scrubPageSize = 64
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is wrapped by every CorruptionError.
+var ErrCorrupt = errors.New("sqlitefs: corrupt fragment")
+
+// CorruptionError reports a fragment whose content no longer matches the
+// CRC-32C stored with it.
+type CorruptionError struct {
+	Path   string // path the fragment belongs to, "" if it is not committed
+	FileID int64
+	Index  int64  // fragment index within the file
+	Want   uint32 // stored checksum
+	Got    uint32 // checksum of the stored content
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("sqlitefs: %s: fragment %d is corrupt (crc32c %08x, expected %08x)", e.Path, e.Index, e.Got, e.Want)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// checksum returns the CRC-32C stored with a fragment.
+func checksum(data []byte) int64 {
+	return int64(crc32.Checksum(data, castagnoli))
+}
+
+// verifyFragment checks a fragment against its stored checksum. Fragments
+// written before checksums were recorded have none and always pass.
+func verifyFragment(path string, fileID, index int64, data []byte, crc sql.NullInt64) error {
+	if !crc.Valid {
+		return nil
+	}
+	if got := checksum(data); got != crc.Int64 {
+		return &CorruptionError{Path: path, FileID: fileID, Index: index, Want: uint32(crc.Int64), Got: uint32(got)}
+	}
+	return nil
+}
+
+// ScrubReport summarizes a Scrub run.
+type ScrubReport struct {
+	Fragments  int64              // fragments read
+	Bytes      int64              // fragment bytes read
+	Unverified int64              // fragments stored without a checksum
+	Damaged    []*CorruptionError // fragments failing verification
+}
+
+// Scrub reads every stored fragment and verifies it against its checksum,
+// including versions that are not committed yet or wait to be reclaimed.
+// Reading is throttled to the rate set with WithScrubRate so a scrub can run
+// alongside regular traffic. Damaged fragments are listed in the report and
+// do not stop the scrub; an error is only returned when the database cannot
+// be read or ctx is done, together with what was scrubbed so far.
+func (fs *SQLiteFS) Scrub(ctx context.Context) (ScrubReport, error) {
+	var report ScrubReport
+	var lastID, lastIndex int64 = 0, -1
+	start := time.Now()
+	for {
+		var n int
+		err := fs.retry(ctx, func() error {
+			n = 0
+			rows, err := fs.stmts.scrubPage.QueryContext(ctx, lastID, lastIndex, scrubPageSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var fileID, index int64
+				var fragment sql.RawBytes
+				var crc sql.NullInt64
+				var path sql.NullString
+				if err := rows.Scan(&fileID, &index, &fragment, &crc, &path); err != nil {
+					return err
+				}
+
+				// Resume after this fragment if the page is retried
+				lastID, lastIndex = fileID, index
+				n++
+				report.Fragments++
+				report.Bytes += int64(len(fragment))
+				if !crc.Valid {
+					report.Unverified++
+				}
+				err := verifyFragment(path.String, fileID, index, fragment, crc)
+				var corrupt *CorruptionError
+				if errors.As(err, &corrupt) {
+					report.Damaged = append(report.Damaged, corrupt)
+				}
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return report, err
+		}
+		if n < scrubPageSize {
+			return report, nil
+		}
+
+		// Wait until the bytes read so far fit the rate
+		if fs.scrubRate > 0 {
+			due := start.Add(time.Duration(float64(report.Bytes) / float64(fs.scrubRate) * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return report, ctx.Err()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	iofs "io/fs"
+	"iter"
+	"os"
+	"strings"
+	"time"
+)
+
+// entriesPageSize is the number of rows Entries and Walk load per query. No
+// rows stay open while the caller's loop body runs.
+const entriesPageSize = 256
+
+// WalkEntry is a file or directory yielded by Walk.
+type WalkEntry struct {
+	Path string // full slash-separated path, without a trailing slash
+	iofs.DirEntry
+}
+
+// Entries returns an iterator over the immediate children of dir. Rows are
+// streamed from the database a page at a time and subdirectories are
+// skipped over in the query itself, so memory use does not depend on the
+// size of the directory. Entries come in byte order of their stored paths;
+// sizes are looked up when Info is called.
+func (fs *SQLiteFS) Entries(dir string) iter.Seq2[iofs.DirEntry, error] {
+	prefix := dirPrefix(dir)
+	return func(yield func(iofs.DirEntry, error) bool) {
+		from, to := prefix, prefixEnd(prefix)
+		found := false
+		for {
+			rows, err := fs.pathRange(from, to)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, row := range rows {
+				if row.path < from || row.path == prefix {
+					// Inside a subdirectory already yielded, or the directory itself
+					continue
+				}
+				name, _, isDir := strings.Cut(row.path[len(prefix):], "/")
+				if isDir {
+					// Continue after the subtree: '0' follows '/'
+					from = prefix + name + "0"
+				}
+				found = true
+				entry := &lazyEntry{fs: fs, name: name, isDir: isDir, id: row.id, storedSize: row.storedSize, sha256: row.sha256}
+				if !yield(entry, nil) {
+					return
+				}
+			}
+
+			if len(rows) < entriesPageSize {
+				break
+			}
+			from = max(from, rows[len(rows)-1].path+"\x00")
+		}
+
+		if !found && prefix != "" {
+			exists, err := fs.dirExists(prefix)
+			if err == nil && !exists {
+				err = &PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+			}
+			if err != nil {
+				yield(nil, err)
+			}
+		}
+	}
+}
+
+// Walk returns an iterator over every file and directory below root, root
+// itself excluded, in byte order of their paths. Directories are derived
+// from the stored file paths and yielded before their contents. Like
+// Entries, it streams a page of rows at a time.
+func (fs *SQLiteFS) Walk(root string) iter.Seq2[WalkEntry, error] {
+	prefix := dirPrefix(root)
+	return func(yield func(WalkEntry, error) bool) {
+		from, to := prefix, prefixEnd(prefix)
+		var dirs []string // directories of the previous path, outermost first
+		found := false
+		for {
+			rows, err := fs.pathRange(from, to)
+			if err != nil {
+				yield(WalkEntry{}, err)
+				return
+			}
+
+			for _, row := range rows {
+				found = true
+				// Leave the directories this path is not in
+				for len(dirs) > 0 && !strings.HasPrefix(row.path, dirs[len(dirs)-1]) {
+					dirs = dirs[:len(dirs)-1]
+				}
+				// Enter the ones it is in, yielding each the first time
+				for i := len(prefix); i < len(row.path); i++ {
+					if row.path[i] != '/' {
+						continue
+					}
+					dirPath := row.path[:i+1]
+					if len(dirs) > 0 && len(dirPath) <= len(dirs[len(dirs)-1]) {
+						continue
+					}
+					dirs = append(dirs, dirPath)
+					entry := &lazyEntry{fs: fs, name: baseName(dirPath), isDir: true}
+					if !yield(WalkEntry{Path: dirPath[:i], DirEntry: entry}, nil) {
+						return
+					}
+				}
+				if strings.HasSuffix(row.path, "/") {
+					continue
+				}
+
+				entry := &lazyEntry{fs: fs, name: baseName(row.path), id: row.id, storedSize: row.storedSize, sha256: row.sha256}
+				if !yield(WalkEntry{Path: row.path, DirEntry: entry}, nil) {
+					return
+				}
+			}
+
+			if len(rows) < entriesPageSize {
+				break
+			}
+			from = rows[len(rows)-1].path + "\x00"
+		}
+
+		if !found && prefix != "" {
+			exists, err := fs.dirExists(prefix)
+			if err == nil && !exists {
+				err = &PathError{Op: "walk", Path: root, Err: os.ErrNotExist}
+			}
+			if err != nil {
+				yield(WalkEntry{}, err)
+			}
+		}
+	}
+}
+
+// pathRow is one file_metadata row loaded by pathRange.
+type pathRow struct {
+	id         int64
+	path       string
+	storedSize sql.NullInt64 // set for inline files and files with a recorded size
+	sha256     []byte
+}
+
+// pathRange loads up to entriesPageSize rows with from <= path < to, in
+// path order. A nil to means no upper bound.
+func (fs *SQLiteFS) pathRange(from string, to any) ([]pathRow, error) {
+	var page []pathRow
+	err := fs.retry(context.Background(), func() error {
+		page = page[:0]
+		rows, err := fs.stmts.pathRange.Query(from, to, entriesPageSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var row pathRow
+			if err := rows.Scan(&row.id, &row.path, &row.storedSize, &row.sha256); err != nil {
+				return err
+			}
+			page = append(page, row)
+		}
+		return rows.Err()
+	})
+	return page, err
+}
+
+// dirPrefix turns a directory name into the prefix shared by the stored
+// paths below it: "" for the root, otherwise the path with a trailing slash.
+func dirPrefix(dir string) string {
+	dir = strings.TrimPrefix(dir, "/")
+	if dir == "" || dir == "." {
+		return ""
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir
+}
+
+// prefixEnd returns the smallest string greater than every path starting
+// with prefix, or nil for the root.
+func prefixEnd(prefix string) any {
+	if prefix == "" {
+		return nil
+	}
+	return prefix[:len(prefix)-1] + "0"
+}
+
+// baseName returns the last element of a stored path.
+func baseName(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// lazyEntry is a directory entry whose file size is only looked up when
+// Info is called.
+type lazyEntry struct {
+	fs         *SQLiteFS
+	name       string
+	isDir      bool
+	id         int64
+	storedSize sql.NullInt64
+	sha256     []byte
+}
+
+func (e *lazyEntry) Name() string { return e.name }
+func (e *lazyEntry) IsDir() bool  { return e.isDir }
+
+func (e *lazyEntry) Type() iofs.FileMode {
+	if e.isDir {
+		return iofs.ModeDir
+	}
+	return 0
+}
+
+func (e *lazyEntry) Info() (iofs.FileInfo, error) {
+	info := &fileInfo{name: e.name, modTime: time.Now(), isDir: e.isDir}
+	if e.isDir {
+		return info, nil
+	}
+	info.sha256 = e.sha256
+	if e.storedSize.Valid {
+		info.size = e.storedSize.Int64
+		return info, nil
+	}
+
+	size, err := e.fs.fileSize(e.id)
+	if err != nil {
+		return nil, err
+	}
+	info.size = size
+	return info, nil
+}
@@ -0,0 +1,419 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileMeta describes a path stored in file_metadata.
+type fileMeta struct {
+	exists   bool
+	id       int64
+	size     int64
+	mimeType string
+	sha256   []byte // nil for files written before digests were stored
+	codec    string // codec of the fragments, "" if uncompressed
+	keyID    string // master key wrapping dataKey, "" if not encrypted
+	dataKey  []byte // wrapped data key of an encrypted file
+	chunked  bool   // fragments are content-defined chunks with stored offsets
+	modTime  time.Time
+	inline   []byte // content of inline files, nil when stored in fragments
+}
+
+// metadataCache keeps path metadata, directory existence and directory
+// listings in memory. Entries are dropped by write-through invalidation from
+// the writer loop and Remove; once maxEntries is reached arbitrary entries
+// are evicted to make room. A result read from the database is only stored
+// if no invalidation ran since the read started, see generation.
+type metadataCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	gen        uint64                 // number of invalidations so far
+	files      map[string]fileMeta    // exact path -> metadata
+	dirs       map[string]bool        // "dir/" prefix -> exists
+	listings   map[string][]*fileInfo // "dir/" prefix -> immediate children
+}
+
+func newMetadataCache(maxEntries int) *metadataCache {
+	return &metadataCache{
+		maxEntries: maxEntries,
+		files:      make(map[string]fileMeta),
+		dirs:       make(map[string]bool),
+		listings:   make(map[string][]*fileInfo),
+	}
+}
+
+func (c *metadataCache) file(path string) (fileMeta, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.files[path]
+	return m, ok
+}
+
+// generation returns the value to pass to the put methods for a result
+// read from the database after this call.
+func (c *metadataCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *metadataCache) putFile(path string, m fileMeta, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.makeRoom()
+	c.files[path] = m
+}
+
+func (c *metadataCache) dir(dirPath string) (exists, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exists, ok = c.dirs[dirPath]
+	return exists, ok
+}
+
+func (c *metadataCache) putDir(dirPath string, exists bool, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.makeRoom()
+	c.dirs[dirPath] = exists
+}
+
+func (c *metadataCache) listing(dirPath string) ([]*fileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	infos, ok := c.listings[dirPath]
+	return infos, ok
+}
+
+func (c *metadataCache) putListing(dirPath string, infos []*fileInfo, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	c.makeRoom()
+	c.listings[dirPath] = infos
+}
+
+// invalidate drops everything a change to path can affect: the path itself
+// and the existence and listing of every ancestor directory.
+func (c *metadataCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Results read before now may predate the change
+	c.gen++
+	delete(c.files, path)
+	for _, dirPath := range parentDirs(path) {
+		delete(c.dirs, dirPath)
+		delete(c.listings, dirPath)
+	}
+}
+
+// makeRoom evicts one arbitrary entry when the cache is full.
+func (c *metadataCache) makeRoom() {
+	if len(c.files)+len(c.dirs)+len(c.listings) < c.maxEntries {
+		return
+	}
+	for path := range c.files {
+		delete(c.files, path)
+		return
+	}
+	for dirPath := range c.listings {
+		delete(c.listings, dirPath)
+		return
+	}
+	for dirPath := range c.dirs {
+		delete(c.dirs, dirPath)
+		return
+	}
+}
+
+// parentDirs returns the directory prefixes containing path, from the root
+// ("") down to its immediate parent, each with a trailing slash.
+func parentDirs(path string) []string {
+	dirs := []string{""}
+	for i := 0; i < len(path)-1; i++ {
+		if path[i] == '/' {
+			dirs = append(dirs, path[:i+1])
+		}
+	}
+	return dirs
+}
+
+// invalidatePath drops cached metadata affected by a change to path.
+func (fs *SQLiteFS) invalidatePath(path string) {
+	if fs.meta != nil {
+		fs.meta.invalidate(path)
+	}
+}
+
+// statFile returns the metadata stored for the exact path.
+func (fs *SQLiteFS) statFile(path string) (fileMeta, error) {
+	var gen uint64
+	if fs.meta != nil {
+		if m, ok := fs.meta.file(path); ok {
+			return m, nil
+		}
+		gen = fs.meta.generation()
+	}
+
+	var m fileMeta
+	var isInline bool
+	var codec, keyID sql.NullString
+	var size sql.NullInt64
+	err := fs.retry(context.Background(), func() error {
+		stmt, err := fs.stmts.get(&fs.stmts.fileByPath)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRow(path).Scan(&m.id, &m.mimeType, &isInline, &m.inline, &m.sha256, &codec, &size, &keyID, &m.dataKey, &m.chunked)
+	})
+	if err != nil && err != sql.ErrNoRows {
+		return m, err
+	}
+	if err == nil {
+		m.exists = true
+		if isInline {
+			// Keep empty inline files distinguishable from fragmented ones
+			if m.inline == nil {
+				m.inline = []byte{}
+			}
+			m.size = int64(len(m.inline))
+		} else {
+			m.inline = nil
+			m.codec = codec.String
+			m.keyID = keyID.String
+			m.size = size.Int64
+			if !size.Valid {
+				// Written before sizes were recorded, so never compressed
+				m.size, err = fs.fileSize(m.id)
+				if err != nil {
+					return m, err
+				}
+			}
+		}
+	}
+	m.modTime = time.Now()
+
+	if fs.meta != nil {
+		fs.meta.putFile(path, m, gen)
+	}
+	return m, nil
+}
+
+// dirExists reports whether any stored path lives under dirPath, which must
+// end with a slash. The empty string denotes the root.
+func (fs *SQLiteFS) dirExists(dirPath string) (bool, error) {
+	var gen uint64
+	if fs.meta != nil {
+		if exists, ok := fs.meta.dir(dirPath); ok {
+			return exists, nil
+		}
+		gen = fs.meta.generation()
+	}
+
+	var exists bool
+	query, args := &fs.stmts.dirExists, []any{dirPath + "%"}
+	if dirPath == "" {
+		query, args = &fs.stmts.rootExists, nil
+	}
+	err := fs.retry(context.Background(), func() error {
+		stmt, err := fs.stmts.get(query)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRow(args...).Scan(&exists)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if fs.meta != nil {
+		fs.meta.putDir(dirPath, exists, gen)
+	}
+	return exists, nil
+}
+
+// listDir returns the immediate children of the directory at path. When n is
+// positive at most n entries are returned.
+func (fs *SQLiteFS) listDir(path string, n int) ([]*fileInfo, error) {
+	// Ensure path ends with / for directory queries
+	dirPath := path
+	if dirPath == "/" {
+		dirPath = ""
+	} else if dirPath != "" && !strings.HasSuffix(dirPath, "/") {
+		dirPath += "/"
+	}
+
+	var gen uint64
+	if fs.meta != nil {
+		if infos, ok := fs.meta.listing(dirPath); ok {
+			if n > 0 && len(infos) > n {
+				infos = infos[:n]
+			}
+			return infos, nil
+		}
+		gen = fs.meta.generation()
+	}
+
+	var children []listedChild
+	err := fs.retry(context.Background(), func() error {
+		var err error
+		children, err = fs.listChildren(dirPath, n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sizes are looked up once the listing query is done so only one
+	// connection is in use at a time.
+	infos := make([]*fileInfo, 0, len(children))
+	for _, c := range children {
+		if !c.info.isDir {
+			c.info.sha256 = c.sha256
+		}
+		if !c.info.isDir && c.storedSize.Valid {
+			c.info.size = c.storedSize.Int64
+		} else if !c.info.isDir {
+			size, err := fs.fileSize(c.id)
+			if err != nil {
+				return nil, err
+			}
+			c.info.size = size
+		}
+		infos = append(infos, c.info)
+	}
+
+	// If no entries were found, check if the directory exists
+	if len(infos) == 0 {
+		exists, err := fs.dirExists(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, errors.New("directory not found")
+		}
+	}
+
+	if fs.meta != nil && n <= 0 {
+		fs.meta.putListing(dirPath, infos, gen)
+	}
+	return infos, nil
+}
+
+// listedChild is an immediate child found by listChildren.
+type listedChild struct {
+	id         int64
+	storedSize sql.NullInt64 // set for inline files and files with a recorded size
+	sha256     []byte
+	info       *fileInfo
+}
+
+// listChildren runs the listing query for dirPath and collapses the stored
+// paths into immediate children, at most n when n is positive.
+func (fs *SQLiteFS) listChildren(dirPath string, n int) ([]listedChild, error) {
+	// Handle root directory specially: list all files
+	listing, args := &fs.stmts.listRoot, []any(nil)
+	if dirPath != "" {
+		// Query to get files in the directory
+		listing, args = &fs.stmts.listDir, []any{dirPath + "%", dirPath}
+	}
+	stmt, err := fs.stmts.get(listing)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []listedChild
+	seenPaths := make(map[string]bool)
+
+	for rows.Next() {
+		var id int64
+		var path string
+		var storedSize sql.NullInt64
+		var sha256 []byte
+		if err := rows.Scan(&id, &path, &storedSize, &sha256); err != nil {
+			return nil, err
+		}
+
+		// Skip the directory itself
+		if dirPath != "" && path == dirPath {
+			continue
+		}
+
+		// Extract the immediate child name
+		relPath := strings.TrimPrefix(path, dirPath)
+		parts := strings.SplitN(relPath, "/", 2)
+		childName := parts[0]
+
+		// If this is a subdirectory entry, add a trailing slash
+		isSubDir := len(parts) > 1 || strings.HasSuffix(path, "/")
+		childPath := dirPath + childName
+		if isSubDir {
+			childPath += "/"
+		}
+
+		// Skip if we've already seen this immediate child
+		if seenPaths[childPath] {
+			continue
+		}
+		seenPaths[childPath] = true
+
+		children = append(children, listedChild{
+			id:         id,
+			storedSize: storedSize,
+			sha256:     sha256,
+			info: &fileInfo{
+				name:    childName,
+				modTime: time.Now(),
+				isDir:   isSubDir,
+			},
+		})
+
+		if n > 0 && len(children) >= n {
+			return children, nil
+		}
+	}
+	return children, rows.Err()
+}
+
+// fileSize computes the size of a file from its fragments.
+func (fs *SQLiteFS) fileSize(fileID int64) (int64, error) {
+	// Get the number of fragments and the size of the last fragment
+	var count, lastFragmentSize int64
+	err := fs.retry(context.Background(), func() error {
+		stmt, err := fs.stmts.get(&fs.stmts.fileSize)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRow(fileID).Scan(&count, &lastFragmentSize)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		// File exists but has no content
+		return 0, nil
+	}
+
+	// Calculate the total file size
+	return (count-1)*fragmentSize + lastFragmentSize, nil
+}
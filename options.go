@@ -0,0 +1,230 @@
+package sqlitefs
+
+import "database/sql"
+
+// defaultWriteInFlight is the number of fragments a writer may queue
+// before Write blocks waiting for the database.
+const defaultWriteInFlight = 4
+
+// Option configures a SQLiteFS created by NewSQLiteFS.
+type Option func(*SQLiteFS)
+
+// WithWriteInFlight sets how many fragments a single SQLiteWriter may have
+// queued for the writer goroutine at once. Values below 1 make every
+// fragment write synchronous.
+func WithWriteInFlight(n int) Option {
+	return func(fs *SQLiteFS) {
+		if n < 1 {
+			n = 1
+		}
+		fs.writeInFlight = n
+	}
+}
+
+// WithReadAhead enables background prefetching for handles that are read
+// sequentially. Up to n fragments beyond the current position are loaded
+// ahead of the reader; a Seek or Close cancels the prefetch. Zero disables
+// read-ahead, which is the default.
+func WithReadAhead(n int) Option {
+	return func(fs *SQLiteFS) {
+		fs.readAhead = max(n, 0)
+	}
+}
+
+// WithFragmentCache enables an LRU cache of fragment contents shared by all
+// handles of the filesystem, holding at most maxBytes of data. Mutations made
+// through this SQLiteFS invalidate affected entries; changes made by other
+// processes are not observed, so only enable it when this instance owns the
+// database.
+func WithFragmentCache(maxBytes int64) Option {
+	return func(fs *SQLiteFS) {
+		if maxBytes <= 0 {
+			fs.cache = nil
+			return
+		}
+		fs.cache = newFragmentCache(maxBytes)
+	}
+}
+
+// WithMetadataCache enables an in-process cache of path metadata, directory
+// existence and directory listings holding at most maxEntries items. The
+// writer loop and Remove keep it up to date, but changes made by other
+// processes sharing the database are not seen; leave it disabled (the
+// default) in that case.
+func WithMetadataCache(maxEntries int) Option {
+	return func(fs *SQLiteFS) {
+		if maxEntries <= 0 {
+			fs.meta = nil
+			return
+		}
+		fs.meta = newMetadataCache(maxEntries)
+	}
+}
+
+// WithInlineStorage stores files of at most maxSize bytes directly in their
+// file_metadata row instead of in file_fragments, saving a row and a lookup
+// per file. maxSize is capped at one fragment; zero disables inline storage,
+// which is the default.
+func WithInlineStorage(maxSize int) Option {
+	return func(fs *SQLiteFS) {
+		fs.inlineMax = min(max(maxSize, 0), fragmentSize)
+	}
+}
+
+// WithReadDB serves Open, Stat, ReadDir and file reads from a separate pool,
+// typically opened read-only on the same database file, so long reads do not
+// queue behind the writer connection passed to NewSQLiteFS. The pool is
+// closed together with the filesystem.
+func WithReadDB(db *sql.DB) Option {
+	return func(fs *SQLiteFS) {
+		fs.readDB = db
+	}
+}
+
+// WithRetryPolicy sets how operations failing because another connection or
+// process holds a lock are retried. DefaultRetryPolicy is used unless this
+// option is given; a zero RetryPolicy disables retries.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(fs *SQLiteFS) {
+		fs.retryPolicy = p
+	}
+}
+
+// WithPOSIXUnlink makes Remove behave like unlink(2): the path disappears at
+// once, but handles that already have the file open keep reading it and its
+// fragments are deleted when the last of them is closed. Replaced versions
+// are always kept alive this way. Open handles are only tracked within this
+// process; once it closes the filesystem or stops renewing its lease for
+// ten minutes, the storage is reclaimed by the next NewSQLiteFS with this
+// option on the database. Without it, or on a read-only database, the
+// instance holds no lease and leftovers of other processes are reclaimed
+// by instances with one once they are an hour old.
+func WithPOSIXUnlink() Option {
+	return func(fs *SQLiteFS) {
+		fs.deferUnlink = true
+	}
+}
+
+// WithWriterMode selects what happens when a writer is created for a path
+// that already has an unclosed writer. The default is WriteLastCloseWins.
+func WithWriterMode(mode WriterMode) Option {
+	return func(fs *SQLiteFS) {
+		fs.writerMode = mode
+	}
+}
+
+// WithScrubRate limits how many fragment bytes per second Scrub reads.
+// Zero removes the limit; the default is 32 MiB per second.
+func WithScrubRate(bytesPerSecond int64) Option {
+	return func(fs *SQLiteFS) {
+		fs.scrubRate = max(bytesPerSecond, 0)
+	}
+}
+
+// WithCompression compresses new files whose MIME type matches one of
+// mimeTypes with codec; patterns are exact types or "type/*", and no
+// patterns match every type. Types that are compressed already, such as
+// PNG, JPEG or ZIP, are always stored as they are. When several rules
+// match, the one given first wins. Files stored with a codec can only be
+// read by a SQLiteFS that knows it: Flate and Gzip are always known, other
+// codecs need WithCompression or WithCodec.
+func WithCompression(codec Codec, mimeTypes ...string) Option {
+	return func(fs *SQLiteFS) {
+		WithCodec(codec)(fs)
+		fs.compression = append(fs.compression, compressionRule{codec: codec, patterns: mimeTypes})
+	}
+}
+
+// WithCodec makes a codec known for reading files without using it for new
+// ones.
+func WithCodec(codec Codec) Option {
+	return func(fs *SQLiteFS) {
+		if fs.codecs == nil {
+			fs.codecs = make(map[string]Codec)
+		}
+		fs.codecs[codec.Name()] = codec
+	}
+}
+
+// WithEncryption encrypts the fragments of new files with AES-GCM under a
+// data key of their own, wrapped with the current master key of keys. Files
+// encrypted earlier are decrypted with the master key they were wrapped
+// with, so keys must keep every master key in use until RotateKeys has
+// moved the files away from it. Encrypted files are never stored inline.
+//
+// Only content is encrypted. Paths, sizes and the plain SHA-256 digest of
+// each file and blob, which Hash and PutBlob report, are stored in the
+// clear, so anyone who can read the database can tell whether it holds a
+// document they know by comparing its digest.
+func WithEncryption(keys KeyProvider) Option {
+	return func(fs *SQLiteFS) {
+		fs.keys = keys
+	}
+}
+
+// WithDeduplication stores the fragments of new files once per content
+// hash, however many files contain them. Fragments are referenced by hash
+// and counted, and released when the last file referring to them is
+// removed or replaced. Encrypted files are not deduplicated. Files written
+// without it stay readable and can be mixed freely with deduplicated ones.
+func WithDeduplication() Option {
+	return func(fs *SQLiteFS) {
+		fs.dedup = true
+	}
+}
+
+// WithChunking splits new files into content-defined chunks instead of
+// fixed 16 KiB fragments, so that inserting or deleting bytes leaves the
+// fragments away from the edit unchanged. Combined with WithDeduplication,
+// versions of a file share most of their storage. Reads locate chunks
+// through their stored offsets, so Seek and ReadAt stay cheap. Writers fail
+// if c is invalid.
+func WithChunking(c Chunking) Option {
+	return func(fs *SQLiteFS) {
+		fs.chunking = c
+	}
+}
+
+// WriterOption configures a SQLiteWriter created by SQLiteFS.NewWriter.
+type WriterOption func(*SQLiteWriter)
+
+// WithExpectedSHA256 makes Close verify the SHA-256 digest of the written
+// content against sum. On a mismatch Close fails with ErrDigestMismatch,
+// the written content is discarded and the path keeps its previous content.
+func WithExpectedSHA256(sum []byte) WriterOption {
+	return func(w *SQLiteWriter) {
+		w.expectSHA256 = sum
+	}
+}
+
+// WithExpectedSize makes the writer fail with ErrSizeMismatch when the
+// written content is not exactly size bytes long. Writes past size fail
+// right away; a shorter file fails in Close. Either way nothing is committed.
+func WithExpectedSize(size int64) WriterOption {
+	return func(w *SQLiteWriter) {
+		w.expectSize = size
+	}
+}
+
+// WithFileCodec compresses this file with codec regardless of the rules set
+// with WithCompression; nil stores it uncompressed. The codec must be known
+// to the SQLiteFS, see WithCompression.
+func WithFileCodec(codec Codec) WriterOption {
+	return func(w *SQLiteWriter) {
+		w.codec = codec
+		if codec == nil {
+			return
+		}
+		if _, err := w.fs.codec(codec.Name()); err != nil && w.err == nil {
+			w.err = &PathError{Op: "write", Path: w.path, Err: err}
+		}
+	}
+}
+
+// WithFileChunking splits this file as c describes regardless of
+// WithChunking; the zero Chunking stores fixed-size fragments.
+func WithFileChunking(c Chunking) WriterOption {
+	return func(w *SQLiteWriter) {
+		w.setChunking(c)
+	}
+}
@@ -0,0 +1,230 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Profile is a named set of SQLite settings applied consistently to the
+// connections opened by OpenSQLiteFS.
+type Profile struct {
+	Name string
+
+	JournalMode string        // PRAGMA journal_mode, e.g. "WAL"
+	Synchronous string        // PRAGMA synchronous, e.g. "NORMAL"
+	BusyTimeout time.Duration // PRAGMA busy_timeout
+	CacheSize   int           // PRAGMA cache_size: pages if positive, KiB if negative, 0 keeps the default
+
+	// WALAutoCheckpoint is the WAL size in pages that triggers an automatic
+	// checkpoint. Zero disables automatic checkpoints.
+	WALAutoCheckpoint int
+	// CheckpointOnClose truncates the WAL when the filesystem is closed.
+	CheckpointOnClose bool
+
+	// ReadConns is the size of the read-only pool.
+	ReadConns int
+}
+
+var (
+	// ProfileServer suits long-running processes with many concurrent
+	// readers: WAL with relaxed fsync and a generous page cache.
+	ProfileServer = Profile{
+		Name:              "server",
+		JournalMode:       "WAL",
+		Synchronous:       "NORMAL",
+		BusyTimeout:       5 * time.Second,
+		CacheSize:         -64 * 1024,
+		WALAutoCheckpoint: 1000,
+		CheckpointOnClose: true,
+		ReadConns:         8,
+	}
+
+	// ProfileEmbedded suits desktop and CLI tools: small caches, few
+	// readers and full durability.
+	ProfileEmbedded = Profile{
+		Name:              "embedded",
+		JournalMode:       "WAL",
+		Synchronous:       "FULL",
+		BusyTimeout:       time.Second,
+		CacheSize:         -2 * 1024,
+		WALAutoCheckpoint: 1000,
+		CheckpointOnClose: true,
+		ReadConns:         2,
+	}
+
+	// ProfileBulkLoad suits one-off imports: no fsync and no automatic
+	// checkpoints while loading, with a single checkpoint on Close. A crash
+	// during the load may lose recent writes.
+	ProfileBulkLoad = Profile{
+		Name:              "bulk-load",
+		JournalMode:       "WAL",
+		Synchronous:       "OFF",
+		BusyTimeout:       30 * time.Second,
+		CacheSize:         -256 * 1024,
+		WALAutoCheckpoint: 0,
+		CheckpointOnClose: true,
+		ReadConns:         1,
+	}
+)
+
+// LookupProfile returns the built-in profile with the given name.
+func LookupProfile(name string) (Profile, bool) {
+	for _, p := range []Profile{ProfileServer, ProfileEmbedded, ProfileBulkLoad} {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// writePragmas returns the statements run on the write connection.
+func (p Profile) writePragmas() []string {
+	var pragmas []string
+	if p.JournalMode != "" {
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+p.JournalMode)
+	}
+	if p.Synchronous != "" {
+		pragmas = append(pragmas, "PRAGMA synchronous = "+p.Synchronous)
+	}
+	pragmas = append(pragmas, p.commonPragmas()...)
+	return append(pragmas, fmt.Sprintf("PRAGMA wal_autocheckpoint = %d", p.WALAutoCheckpoint))
+}
+
+// readPragmas returns the statements run on every read-only connection.
+func (p Profile) readPragmas() []string {
+	return append(p.commonPragmas(), "PRAGMA query_only = ON")
+}
+
+func (p Profile) commonPragmas() []string {
+	pragmas := []string{fmt.Sprintf("PRAGMA busy_timeout = %d", p.BusyTimeout.Milliseconds())}
+	if p.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", p.CacheSize))
+	}
+	return pragmas
+}
+
+// OpenSQLiteFS opens the database file named by dsn twice: once as the
+// single write connection used by the writer goroutine and once as a
+// read-only pool of profile.ReadConns connections serving Open, Stat and
+// ReadDir. The profile settings are applied to every connection as it is
+// opened. The dsn must name a file; private in-memory databases are not
+// shared between the two pools.
+func OpenSQLiteFS(driverName, dsn string, profile Profile, opts ...Option) (*SQLiteFS, error) {
+	writeDB, err := openWithPragmas(driverName, dsn, profile.writePragmas())
+	if err != nil {
+		return nil, err
+	}
+	writeDB.SetMaxOpenConns(1)
+	writeDB.SetMaxIdleConns(1)
+	writeDB.SetConnMaxLifetime(0)
+
+	// Switch the journal mode before any reader connects
+	if err := writeDB.Ping(); err != nil {
+		writeDB.Close()
+		return nil, err
+	}
+
+	readDB, err := openWithPragmas(driverName, dsn, profile.readPragmas())
+	if err != nil {
+		writeDB.Close()
+		return nil, err
+	}
+	readConns := max(profile.ReadConns, 1)
+	readDB.SetMaxOpenConns(readConns)
+	readDB.SetMaxIdleConns(readConns)
+
+	opts = append([]Option{WithReadDB(readDB)}, opts...)
+	if profile.CheckpointOnClose {
+		opts = append(opts, func(fs *SQLiteFS) { fs.checkpointOnClose = true })
+	}
+	fs, err := NewSQLiteFS(writeDB, opts...)
+	if err != nil {
+		readDB.Close()
+		writeDB.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// openWithPragmas opens a pool whose connections run pragmas right after
+// they are established.
+func openWithPragmas(driverName, dsn string, pragmas []string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	var connector driver.Connector = dsnConnector{driver: drv, dsn: dsn}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		connector, err = dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(&pragmaConnector{Connector: connector, pragmas: pragmas}), nil
+}
+
+// dsnConnector adapts a driver without connector support.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// pragmaConnector runs a fixed list of statements on every new connection.
+type pragmaConnector struct {
+	driver.Connector
+	pragmas []string
+}
+
+func (c *pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range c.pragmas {
+		if err := execConn(ctx, conn, pragma); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+// execConn runs a statement without arguments on a raw driver connection,
+// discarding any rows it returns.
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if queryer, ok := conn.(driver.QueryerContext); ok {
+		rows, err := queryer.QueryContext(ctx, query, nil)
+		if !errors.Is(err, driver.ErrSkip) {
+			if err != nil {
+				return err
+			}
+			return rows.Close()
+		}
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(nil)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
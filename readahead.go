@@ -0,0 +1,158 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+)
+
+// prefetchedFragment is one fragment delivered by a prefetcher.
+type prefetchedFragment struct {
+	index int64
+	start int64 // offset in the file the fragment starts at
+	data  []byte
+	err   error
+}
+
+// prefetcher loads fragments of a file in the background, in order, into a
+// channel bounded by the read-ahead window.
+type prefetcher struct {
+	cancel context.CancelFunc
+	ch     chan prefetchedFragment
+	done   chan struct{}
+
+	cur      []byte // fragment currently being consumed
+	curStart int64
+}
+
+// readSequential serves Read when read-ahead is enabled. Reads that continue
+// where the previous one ended start a prefetcher; anything else goes
+// straight to the database.
+func (f *SQLiteFile) readSequential(p []byte) (int, error) {
+	sequential := f.offset == f.lastReadEnd
+
+	if f.prefetch == nil {
+		n, err := f.readFragments(p, f.offset)
+		end := f.offset + int64(n)
+		f.lastReadEnd = end
+		if sequential && err == nil && end < f.size {
+			// The next read may still need the rest of the current fragment
+			if index, start, err := f.locate(end); err == nil {
+				f.startPrefetch(index, start)
+			}
+		}
+		return n, err
+	}
+
+	bytesReadTotal := 0
+	for bytesReadTotal < len(p) {
+		pos := f.offset + int64(bytesReadTotal)
+		if pos >= f.size {
+			break
+		}
+
+		fragment, start, err := f.prefetch.fragmentAt(pos)
+		if err != nil {
+			f.stopPrefetch()
+			return bytesReadTotal, err
+		}
+		if fragment == nil {
+			// Missing fragment: behave like a direct read and stop here
+			break
+		}
+
+		internalOffset := pos - start
+		if internalOffset >= int64(len(fragment)) {
+			break
+		}
+		bytesReadTotal += copy(p[bytesReadTotal:], fragment[internalOffset:])
+	}
+
+	f.lastReadEnd = f.offset + int64(bytesReadTotal)
+	if bytesReadTotal == 0 {
+		f.stopPrefetch()
+		return f.readFragments(p, f.offset)
+	}
+	return bytesReadTotal, nil
+}
+
+// startPrefetch begins loading fragments from index onwards, the first
+// starting at offset start, at most readAhead fragments per query, blocking
+// once the window is full. It stops at the first missing fragment, after
+// which the offsets of later ones are unknown.
+func (f *SQLiteFile) startPrefetch(from, start int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pf := &prefetcher{
+		cancel:   cancel,
+		ch:       make(chan prefetchedFragment, f.fs.readAhead),
+		done:     make(chan struct{}),
+		curStart: -1,
+	}
+	f.prefetch = pf
+
+	batch := int64(f.fs.readAhead)
+
+	go func() {
+		defer close(pf.done)
+		defer close(pf.ch)
+
+		next := from
+		for start < f.size {
+			// Load the whole batch before sending so no rows stay open
+			// while the reader is slow.
+			var fragments []prefetchedFragment
+			gap := false
+			err := f.eachFragment(ctx, next, next+batch-1, func(index int64, fragment []byte) bool {
+				if index != next {
+					gap = true
+					return false
+				}
+				fragments = append(fragments, prefetchedFragment{index: index, start: start, data: bytes.Clone(fragment)})
+				next, start = index+1, f.fragmentStart(index+1, start, len(fragment))
+				return true
+			})
+			if err != nil {
+				fragments = append(fragments, prefetchedFragment{err: err})
+			}
+			for _, fragment := range fragments {
+				select {
+				case pf.ch <- fragment:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil || gap || len(fragments) < int(batch) {
+				return
+			}
+		}
+	}()
+}
+
+// stopPrefetch cancels the active prefetcher and waits for it to exit.
+func (f *SQLiteFile) stopPrefetch() {
+	if f.prefetch == nil {
+		return
+	}
+	f.prefetch.cancel()
+	<-f.prefetch.done
+	f.prefetch = nil
+}
+
+// fragmentAt returns the fragment holding offset pos from the prefetched
+// stream and the offset it starts at, skipping fragments the reader has
+// moved past. It returns nil when the fragment is not available.
+func (pf *prefetcher) fragmentAt(pos int64) ([]byte, int64, error) {
+	for pf.curStart < 0 || pos < pf.curStart || pos >= pf.curStart+int64(len(pf.cur)) {
+		next, ok := <-pf.ch
+		if !ok {
+			return nil, 0, nil
+		}
+		if next.err != nil {
+			return nil, 0, next.err
+		}
+		if next.start > pos {
+			return nil, 0, nil
+		}
+		pf.cur, pf.curStart = next.data, next.start
+	}
+	return pf.cur, pf.curStart, nil
+}
@@ -0,0 +1,146 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned, wrapping the last driver error, when an operation
+// still finds the database busy or locked after every retry allowed by the
+// RetryPolicy.
+var ErrBusy = errors.New("sqlitefs: database busy")
+
+// RetryPolicy controls how statements and transactions failing with
+// SQLITE_BUSY or SQLITE_LOCKED are retried. The delay before retry n is
+// InitialBackoff*Multiplier^(n-1), capped at MaxBackoff and randomized by
+// ±Jitter of its value. Every failed attempt is retried as a whole: a
+// transaction is rolled back and run again from the start.
+type RetryPolicy struct {
+	MaxAttempts    int // attempts including the first; values below 2 disable retries
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64 // fraction of the delay, between 0 and 1
+}
+
+// DefaultRetryPolicy keeps retrying for a few seconds, which covers the
+// transactions of another SQLiteFS sharing the database file.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    20,
+	InitialBackoff: 2 * time.Millisecond,
+	MaxBackoff:     500 * time.Millisecond,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// RetryStats counts busy retries made by a SQLiteFS.
+type RetryStats struct {
+	Retries   int64         // failed attempts that were retried
+	Recovered int64         // operations that succeeded after retrying
+	Exhausted int64         // operations that failed with ErrBusy
+	Waited    time.Duration // total time spent backing off
+}
+
+// retryCounters is the live form of RetryStats.
+type retryCounters struct {
+	retries   atomic.Int64
+	recovered atomic.Int64
+	exhausted atomic.Int64
+	waited    atomic.Int64
+}
+
+// RetryStats returns the busy retry counters of the filesystem.
+func (fs *SQLiteFS) RetryStats() RetryStats {
+	return RetryStats{
+		Retries:   fs.retryCounters.retries.Load(),
+		Recovered: fs.retryCounters.recovered.Load(),
+		Exhausted: fs.retryCounters.exhausted.Load(),
+		Waited:    time.Duration(fs.retryCounters.waited.Load()),
+	}
+}
+
+// retry runs op until it succeeds, fails with an error other than busy or
+// locked, the retry policy is exhausted or ctx is done.
+func (fs *SQLiteFS) retry(ctx context.Context, op func() error) error {
+	policy := fs.retryPolicy
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			if attempt > 1 {
+				fs.retryCounters.recovered.Add(1)
+			}
+			return nil
+		}
+		if !isBusy(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			if policy.MaxAttempts > 1 {
+				fs.retryCounters.exhausted.Add(1)
+				return fmt.Errorf("%w after %d attempts: %w", ErrBusy, attempt, err)
+			}
+			return err
+		}
+
+		delay := backoff
+		if policy.Jitter > 0 {
+			delay += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(backoff))
+			delay = max(delay, 0)
+		}
+		fs.retryCounters.retries.Add(1)
+		fs.retryCounters.waited.Add(int64(delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		backoff = time.Duration(float64(backoff) * max(policy.Multiplier, 1))
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED,
+// including their extended codes. Drivers exposing a Code method are
+// checked by code, others by message.
+func isBusy(err error) bool {
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		switch coded.Code() & 0xff {
+		case 5, 6: // SQLITE_BUSY, SQLITE_LOCKED
+			return true
+		}
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY") ||
+		strings.Contains(msg, "SQLITE_LOCKED")
+}
+
+// isReadOnly reports whether err is SQLite's SQLITE_READONLY, the error of
+// a write to a database opened read-only.
+func isReadOnly(err error) bool {
+	if err == nil {
+		return false
+	}
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		return coded.Code()&0xff == 8 // SQLITE_READONLY
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "readonly database") ||
+		strings.Contains(msg, "SQLITE_READONLY")
+}
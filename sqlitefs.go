@@ -1,41 +1,143 @@
 package sqlitefs
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"io/fs"
 	"sync"
+	"time"
+)
+
+// writeOp selects what the writer goroutine does with a writeRequest.
+type writeOp int
+
+const (
+	opFragment   writeOp = iota // store data as fragment index of fileID
+	opReserve                   // allocate the file id of a new version
+	opCommit                    // bind path to fileID, or to inline data
+	opDiscard                   // drop the fragments of an uncommitted fileID
+	opCommitBlob                // store fileID as the blob with digest sha256
+	opCopyBlob                  // copy the fragments of blob sha256 to fileID
 )
 
 type writeRequest struct {
+	op       writeOp
 	path     string
+	fileID   int64
+	source   int64 // file id of the blob copied by opCopyBlob
 	data     []byte
 	index    int
+	offset   int64 // position of the fragment in the file, stored if chunked
+	chunked  bool  // fragments are content-defined chunks
 	mimeType string
-	respCh   chan error
+	sha256   []byte // digest of the whole content, set on commit
+	codec    string // codec of the fragments, "" if stored uncompressed
+	size     int64  // size of the whole content, set on commit
+	keyID    string // master key wrapping dataKey, "" if not encrypted
+	dataKey  []byte // wrapped data key of an encrypted file
+	blob     []byte // content hash to store the fragment under, nil to store it in place
+	inline   bool   // commit request carrying the whole file in data
+	respCh   chan writeResult
 }
 
+type writeResult struct {
+	fileID int64 // id allocated by opReserve
+	err    error
+}
+
+// reservePath is the placeholder path used while allocating a file id. It
+// is never committed, so it cannot clash with a real file.
+const reservePath = "\x00reserve"
+
 type SQLiteFS struct {
-	db       *sql.DB
+	db       *sql.DB // write connection used by the writer goroutine
+	readDB   *sql.DB // pool serving reads, db unless WithReadDB is used
 	writeCh  chan writeRequest
 	writerWg sync.WaitGroup
+
+	writeInFlight int   // max queued fragments per writer
+	readAhead     int   // fragments prefetched by sequential readers
+	inlineMax     int   // largest file stored inline, 0 disables inline storage
+	scrubRate     int64 // fragment bytes Scrub reads per second, 0 for no limit
+
+	checkpointOnClose bool       // truncate the WAL in Close
+	deferUnlink       bool       // Remove keeps content readable through open handles
+	writerMode        WriterMode // what happens when a path gets a second writer
+
+	codecs      map[string]Codec  // codecs given with WithCompression or WithCodec
+	compression []compressionRule // codec selection for new files, first match wins
+	keys        KeyProvider       // encrypts new files and decrypts stored ones, nil if disabled
+	dedup       bool              // store new fragments once per content hash
+	chunking    Chunking          // fragment boundaries of new files, zero for fixed-size fragments
+
+	retryPolicy   RetryPolicy
+	retryCounters retryCounters
+
+	cache    *fragmentCache  // shared fragment cache, nil if disabled
+	meta     *metadataCache  // path metadata cache, nil if disabled
+	stmts    *statements     // prepared hot-path queries
+	versions *versionTracker // open handles per file id
+
+	instance  string         // id of this instance in file_instances, owner of its file_reclaim entries; empty without a lease
+	leaseDone chan struct{}  // closed by Close to stop renewing the lease
+	leaseWg   sync.WaitGroup // the lease goroutine
+
+	writingMu sync.Mutex
+	writing   map[string]bool // paths with an active writer in WriteExclusive mode
 }
 
 var _ fs.FS = (*SQLiteFS)(nil)
 
 // NewSQLiteFS создает новый экземпляр SQLiteFS с заданной базой данных.
 // Проверяет наличие необходимых таблиц и создает их при отсутствии.
-func NewSQLiteFS(db *sql.DB) (*SQLiteFS, error) {
+func NewSQLiteFS(db *sql.DB, opts ...Option) (*SQLiteFS, error) {
 	fs := &SQLiteFS{
-		db:      db,
-		writeCh: make(chan writeRequest),
+		db:            db,
+		writeCh:       make(chan writeRequest),
+		writeInFlight: defaultWriteInFlight,
+		retryPolicy:   DefaultRetryPolicy,
+		scrubRate:     defaultScrubRate,
+		versions:      newVersionTracker(),
+		writing:       make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	if fs.readDB == nil {
+		fs.readDB = db
 	}
 
-	err := fs.createTablesIfNeeded()
+	err := fs.retry(context.Background(), fs.createTablesIfNeeded)
 	if err != nil {
 		return nil, err
 	}
 
+	fs.stmts, err = prepareStatements(fs.readDB, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only deferred unlinks leave entries behind that need a lease to be
+	// told apart from those of crashed instances
+	if fs.deferUnlink {
+		err = fs.register()
+		if err != nil {
+			fs.stmts.close()
+			return nil, err
+		}
+	}
+	if fs.instance != "" {
+		err = fs.reclaimLeftovers()
+		if err != nil {
+			fs.unregister()
+			fs.stmts.close()
+			return nil, err
+		}
+		fs.leaseWg.Add(1)
+		go fs.renewLease()
+	}
+
 	fs.writerWg.Add(1)
 	go fs.writerLoop()
 
@@ -43,8 +145,12 @@ func NewSQLiteFS(db *sql.DB) (*SQLiteFS, error) {
 }
 
 // NewWriter creates a new writer for the specified path.
-func (fs *SQLiteFS) NewWriter(path string) *SQLiteWriter {
-	return NewSQLiteWriter(fs, path)
+func (fs *SQLiteFS) NewWriter(path string, opts ...WriterOption) *SQLiteWriter {
+	w := NewSQLiteWriter(fs, path)
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
 // Open opens the named file.
@@ -61,47 +167,56 @@ func (fs *SQLiteFS) Open(name string) (fs.File, error) {
 	}
 
 	// Check if the file exists directly
-	var exists bool
-	err := fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path = ?)", dbPath).Scan(&exists)
+	meta, err := fs.statFile(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if exists {
-		return NewSQLiteFile(fs.db, dbPath)
+	if meta.exists {
+		return newSQLiteFile(fs, dbPath)
 	}
 
 	// If not found directly, check if it's a directory by looking for files with this prefix
 	// This handles the case where the directory itself isn't explicitly stored
 	if dbPath == "" {
-		// Root directory - check if any files exist
-		err = fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata LIMIT 1)").Scan(&exists)
-		if err != nil {
-			return nil, err
-		}
-		if exists || dbPath == "" { // Root always exists even if empty
-			return NewSQLiteFile(fs.db, "")
-		}
-	} else {
-		dirPath := dbPath
-		if len(dirPath) > 0 && dirPath[len(dirPath)-1] != '/' {
-			dirPath += "/"
-		}
+		// Root always exists even if empty
+		return newSQLiteFile(fs, "")
+	}
 
-		err = fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ? LIMIT 1)", dirPath+"%").Scan(&exists)
-		if err != nil {
-			return nil, err
-		}
+	dirPath := dbPath
+	if dirPath[len(dirPath)-1] != '/' {
+		dirPath += "/"
+	}
 
-		if exists {
-			// It's a directory, create a directory file
-			return NewSQLiteFile(fs.db, dirPath)
-		}
+	exists, err := fs.dirExists(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		// It's a directory, create a directory file
+		return newSQLiteFile(fs, dirPath)
 	}
 
 	return nil, fs.Error("file does not exist", name)
 }
 
+// CacheStats returns hit and miss statistics of the shared fragment cache.
+// It reports zero values when the cache is disabled.
+func (fs *SQLiteFS) CacheStats() CacheStats {
+	if fs.cache == nil {
+		return CacheStats{}
+	}
+	return fs.cache.snapshot()
+}
+
+// invalidateFile drops cached state for a file id after it was mutated.
+func (fs *SQLiteFS) invalidateFile(fileID int64) {
+	if fs.cache != nil {
+		fs.cache.invalidateFile(fileID)
+	}
+}
+
 // Error returns a formatted error that includes the path
 func (fs *SQLiteFS) Error(msg, path string) error {
 	return &PathError{Op: "open", Path: path, Err: errors.New(msg)}
@@ -118,25 +233,129 @@ func (e *PathError) Error() string {
 	return e.Op + " " + e.Path + ": " + e.Err.Error()
 }
 
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
 // createTablesIfNeeded создает таблицы file_metadata и file_fragments, если они еще не созданы.
 func (fs *SQLiteFS) createTablesIfNeeded() error {
 	_, err := fs.db.Exec(`
         CREATE TABLE IF NOT EXISTS file_metadata (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             path TEXT UNIQUE NOT NULL,
-            type TEXT NOT NULL
+            type TEXT NOT NULL,
+            data BLOB,
+            sha256 BLOB,
+            codec TEXT,
+            size INTEGER,
+            key_id TEXT,
+            data_key BLOB,
+            chunked INTEGER
         );
-        CREATE TABLE IF NOT EXISTS file_fragments (
-            file_id INTEGER NOT NULL,
-            fragment_index INTEGER NOT NULL,
-            fragment BLOB NOT NULL,
-            PRIMARY KEY (file_id, fragment_index),
-            FOREIGN KEY (file_id) REFERENCES file_metadata(id)
+        CREATE TABLE IF NOT EXISTS file_fragments ` + fragmentColumns + `;
+        CREATE TABLE IF NOT EXISTS file_reclaim (
+            file_id INTEGER PRIMARY KEY,
+            reason TEXT NOT NULL,
+            created_at INTEGER NOT NULL,
+            owner TEXT
         );
         CREATE INDEX IF NOT EXISTS idx_file_metadata_path ON file_metadata(path);
-        CREATE INDEX IF NOT EXISTS idx_file_fragments_length ON file_fragments(file_id, length(fragment));
     `)
 
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the first release
+	if err := fs.addColumnIfMissing("file_metadata", "data", "BLOB"); err != nil {
+		return err
+	}
+	for _, column := range []struct{ name, decl string }{
+		{"sha256", "BLOB"},
+		{"codec", "TEXT"},
+		{"size", "INTEGER"},
+		{"key_id", "TEXT"},
+		{"data_key", "BLOB"},
+		{"chunked", "INTEGER"},
+	} {
+		if err := fs.addColumnIfMissing("file_metadata", column.name, column.decl); err != nil {
+			return err
+		}
+	}
+	for _, column := range []struct{ name, decl string }{
+		{"crc32c", "INTEGER"},
+		{"blob", "BLOB"},
+		{"byte_offset", "INTEGER"},
+	} {
+		if err := fs.addColumnIfMissing("file_fragments", column.name, column.decl); err != nil {
+			return err
+		}
+	}
+	if err := fs.addColumnIfMissing("file_reclaim", "owner", "TEXT"); err != nil {
+		return err
+	}
+	if err := fs.dropFragmentsForeignKey(); err != nil {
+		return err
+	}
+	_, err = fs.db.Exec(dedupSchema + blobSchema + instanceSchema + `
+		CREATE INDEX IF NOT EXISTS idx_file_fragments_length ON file_fragments(file_id, length(fragment));
+		CREATE INDEX IF NOT EXISTS idx_file_fragments_offset ON file_fragments(file_id, byte_offset) WHERE byte_offset IS NOT NULL;
+	`)
+	return err
+}
+
+// fragmentColumns declares file_fragments. Fragments of uploads that have
+// not committed yet, of unlinked versions and of blobs have no file_metadata
+// row, so file_id has no foreign key.
+const fragmentColumns = `(
+            file_id INTEGER NOT NULL,
+            fragment_index INTEGER NOT NULL,
+            fragment BLOB NOT NULL,
+            crc32c INTEGER,
+            blob BLOB,
+            byte_offset INTEGER,
+            PRIMARY KEY (file_id, fragment_index)
+        )`
+
+// dropFragmentsForeignKey rebuilds a file_fragments table created by an
+// older version, which declared a foreign key on file_metadata that fails
+// every commit once foreign_keys is enabled. Indexes and triggers go with
+// the old table and are created again afterwards.
+func (fs *SQLiteFS) dropFragmentsForeignKey() error {
+	var exists bool
+	err := fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_foreign_key_list('file_fragments'))").Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE file_fragments_rebuild ` + fragmentColumns + `;
+		INSERT INTO file_fragments_rebuild (file_id, fragment_index, fragment, crc32c, blob, byte_offset)
+		SELECT file_id, fragment_index, fragment, crc32c, blob, byte_offset FROM file_fragments;
+		DROP TABLE file_fragments;
+		ALTER TABLE file_fragments_rebuild RENAME TO file_fragments;
+	`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing upgrades a table created by an older version.
+func (fs *SQLiteFS) addColumnIfMissing(table, column, decl string) error {
+	var exists bool
+	err := fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = fs.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
 	return err
 }
 
@@ -144,47 +363,185 @@ func (fs *SQLiteFS) writerLoop() {
 	defer fs.writerWg.Done()
 
 	for req := range fs.writeCh {
-		var err error
-		if req.mimeType != "" {
-			err = fs.createFileRecord(req.path, req.mimeType)
-		} else {
-			err = fs.writeFragment(req.path, req.data, req.index)
+		var res writeResult
+		switch req.op {
+		case opFragment:
+			if req.blob != nil {
+				res.err = fs.writeBlobFragment(req)
+			} else {
+				res.err = fs.writeFragment(req)
+			}
+		case opReserve:
+			res.fileID, res.err = fs.reserveFileID()
+		case opCommit:
+			res.err = fs.commitFile(req)
+		case opDiscard:
+			res.err = fs.reclaim(req.fileID)
+		case opCommitBlob:
+			res.err = fs.commitBlob(req)
+		case opCopyBlob:
+			res.err = fs.copyBlob(req)
 		}
-		req.respCh <- err
+		req.respCh <- res
 	}
 }
 
-func (fs *SQLiteFS) createFileRecord(path, mimeType string) error {
-	_, err := fs.db.Exec("INSERT OR REPLACE INTO file_metadata (path, type) VALUES (?, ?)", path, mimeType)
-	return err
+// request sends a single request to the writer goroutine and waits for it.
+func (fs *SQLiteFS) request(req writeRequest) writeResult {
+	req.respCh = make(chan writeResult)
+	fs.writeCh <- req
+	return <-req.respCh
 }
 
-func (fs *SQLiteFS) writeFragment(path string, data []byte, index int) error {
-	tx, err := fs.db.Begin()
-	if err != nil {
-		return err
+// reserveFileID allocates the id under which a writer stores the fragments
+// of a new version. AUTOINCREMENT never hands out an id twice, so a row that
+// is inserted and deleted again reserves its id without being visible.
+func (fs *SQLiteFS) reserveFileID() (int64, error) {
+	var fileID int64
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Stmt(fs.stmts.insertPlaceholder).Exec(reservePath)
+		if err != nil {
+			return err
+		}
+		fileID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(fs.stmts.deleteFileByID).Exec(fileID)
+		if err != nil {
+			return err
+		}
+		// Reclaimed by a later start if the writer never commits
+		_, err = tx.Stmt(fs.stmts.insertReclaim).Exec(fileID, reclaimUpload, time.Now().Unix(), fs.owner())
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return fileID, err
+}
+
+// commitFile makes a written version the current content of its path in a
+// single statement, so readers see either the previous version or the
+// complete new one. Inline requests store the whole content in the row
+// itself.
+func (fs *SQLiteFS) commitFile(req writeRequest) error {
+	path := req.path
+	var fileID, data, codec, keyID, chunked any
+	if req.fileID != 0 {
+		fileID = req.fileID
+	}
+	if req.codec != "" {
+		codec = req.codec
+	}
+	if req.keyID != "" {
+		keyID = req.keyID
+	}
+	if req.chunked {
+		chunked = true
+	}
+	if req.inline {
+		data = req.data
 	}
-	defer tx.Rollback()
 
-	var fileID int64
-	err = tx.QueryRow("SELECT id FROM file_metadata WHERE path = ?", path).Scan(&fileID)
+	var oldID int64
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		oldID = 0
+		err = tx.Stmt(fs.stmts.fileIDByPath).QueryRow(path).Scan(&oldID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if req.fileID != 0 {
+			result, err := tx.Stmt(fs.stmts.deleteUpload).Exec(req.fileID)
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				return errUploadReclaimed
+			}
+		}
+
+		_, err = tx.Stmt(fs.stmts.insertFile).Exec(fileID, path, req.mimeType, data, req.sha256, codec, req.size, keyID, req.dataKey, chunked)
+		if err != nil {
+			return err
+		}
+
+		// The replaced version stays until nothing reads it anymore
+		if oldID != 0 {
+			_, err = tx.Stmt(fs.stmts.insertReclaim).Exec(oldID, reclaimUnlinked, time.Now().Unix(), fs.owner())
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec("INSERT OR REPLACE INTO file_fragments (file_id, fragment_index, fragment) VALUES (?, ?, ?)",
-		fileID, index, data)
-	if err != nil {
-		return err
+	fs.invalidatePath(path)
+	if oldID != 0 {
+		// The commit stands even if this fails; the next start retries it
+		fs.unlinkVersion(oldID)
 	}
+	return nil
+}
 
-	return tx.Commit()
+// writeFragment stores one fragment of a version that is not committed yet.
+// Nothing can read or cache it before the commit, so no invalidation is
+// needed.
+func (fs *SQLiteFS) writeFragment(req writeRequest) error {
+	return fs.retry(context.Background(), func() error {
+		_, err := fs.stmts.insertFragment.Exec(req.fileID, req.index, req.data, checksum(req.data), req.byteOffset())
+		return err
+	})
+}
+
+// byteOffset returns the offset stored with a fragment: its position for
+// chunks, NULL for fixed-size fragments whose position follows from the
+// index.
+func (req writeRequest) byteOffset() any {
+	if !req.chunked {
+		return nil
+	}
+	return req.offset
 }
 
 func (fs *SQLiteFS) Close() error {
+	fs.versions.close()
 	close(fs.writeCh)
 	fs.writerWg.Wait()
-	return fs.db.Close()
+	var errs []error
+	if fs.instance != "" {
+		close(fs.leaseDone)
+		fs.leaseWg.Wait()
+		// Entries still journaled are reclaimed by the next NewSQLiteFS
+		errs = append(errs, fs.unregister())
+	}
+	errs = append(errs, fs.stmts.close())
+	if fs.readDB != fs.db {
+		errs = append(errs, fs.readDB.Close())
+	}
+	// Readers are gone, so the checkpoint can reset the whole WAL
+	if fs.checkpointOnClose {
+		_, err := fs.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+		errs = append(errs, err)
+	}
+	errs = append(errs, fs.db.Close())
+	return errors.Join(errs...)
 }
 
 // Remove deletes a file or empty directory from the filesystem.
@@ -200,32 +557,64 @@ func (fs *SQLiteFS) Remove(path string) error {
 		path = path[:len(path)-1]
 	}
 
-	// Check if this is a directory (has children)
-	var hasChildren bool
-	dirPrefix := path + "/"
-	err := fs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ? AND path != ?)", dirPrefix+"%", path).Scan(&hasChildren)
-	if err != nil {
-		return err
-	}
-	if hasChildren {
-		return &PathError{Op: "remove", Path: path, Err: errors.New("directory not empty")}
-	}
+	var fileID int64
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
 
-	// Delete fragments first (due to foreign key constraint)
-	_, err = fs.db.Exec(`DELETE FROM file_fragments WHERE file_id IN (SELECT id FROM file_metadata WHERE path = ?)`, path)
-	if err != nil {
-		return err
-	}
+		// Check if this is a directory (has children)
+		var hasChildren bool
+		dirPrefix := path + "/"
+		err = tx.Stmt(fs.stmts.hasChildren).QueryRow(dirPrefix+"%", path).Scan(&hasChildren)
+		if err != nil {
+			return err
+		}
+		if hasChildren {
+			return &PathError{Op: "remove", Path: path, Err: errors.New("directory not empty")}
+		}
 
-	// Delete metadata
-	result, err := fs.db.Exec(`DELETE FROM file_metadata WHERE path = ?`, path)
+		fileID = 0
+		err = tx.Stmt(fs.stmts.fileIDByPath).QueryRow(path).Scan(&fileID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if fs.deferUnlink {
+			// Open handles keep reading; the last Close reclaims
+			if fileID != 0 {
+				_, err = tx.Stmt(fs.stmts.insertReclaim).Exec(fileID, reclaimUnlinked, time.Now().Unix(), fs.owner())
+			}
+		} else {
+			// Delete the fragments along with the metadata
+			_, err = tx.Stmt(fs.stmts.deleteFragments).Exec(path)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Delete metadata
+		result, err := tx.Stmt(fs.stmts.deleteFile).Exec(path)
+		if err != nil {
+			return err
+		}
+
+		rows, _ := result.RowsAffected()
+		if rows == 0 {
+			return &PathError{Op: "remove", Path: path, Err: errors.New("file not found")}
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return err
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return &PathError{Op: "remove", Path: path, Err: errors.New("file not found")}
+	fs.invalidatePath(path)
+	if fs.deferUnlink {
+		return fs.unlinkVersion(fileID)
 	}
+	fs.invalidateFile(fileID)
 	return nil
 }
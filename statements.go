@@ -0,0 +1,220 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// statements holds the prepared statements for every query on the hot
+// path. They are prepared once per SQLiteFS and closed by Close; the writer
+// loop binds them to its transactions with tx.Stmt. Lookups and content
+// reads use the read pool, everything Remove and the writer loop run uses
+// the write connection.
+type statements struct {
+	// Lookups
+	fileByPath   *sql.Stmt
+	fileSize     *sql.Stmt
+	chunkAt      *sql.Stmt
+	blobByDigest *sql.Stmt
+	rootExists   *sql.Stmt
+	dirExists    *sql.Stmt
+
+	// Content and listings
+	fragmentRange *sql.Stmt
+	scrubPage     *sql.Stmt
+	listRoot      *sql.Stmt
+	listDir       *sql.Stmt
+	pathRange     *sql.Stmt
+	walkTree      *sql.Stmt
+
+	// Writer side
+	fileIDByPath        *sql.Stmt
+	hasChildren         *sql.Stmt
+	insertPlaceholder   *sql.Stmt
+	insertFile          *sql.Stmt
+	insertFragment      *sql.Stmt
+	insertBlob          *sql.Stmt
+	insertBlobRef       *sql.Stmt
+	setHash             *sql.Stmt
+	deleteFragments     *sql.Stmt
+	deleteFragmentsByID *sql.Stmt
+	deleteFile          *sql.Stmt
+	deleteFileByID      *sql.Stmt
+
+	// Reclaim journal
+	insertReclaim *sql.Stmt
+	deleteUpload  *sql.Stmt
+	deleteReclaim *sql.Stmt
+	reclaimable   *sql.Stmt
+
+	// Set by lazyFileStatements, see get
+	lazyMu   sync.Mutex
+	lazyDB   *sql.DB               // pool the pending queries are prepared on
+	lazyPrep map[**sql.Stmt]string // statements not prepared yet -> query
+}
+
+// statementQuery is a statement of statements with its query and the pool
+// it is prepared on.
+type statementQuery struct {
+	db    *sql.DB
+	stmt  **sql.Stmt
+	query string
+}
+
+// prepareStatements prepares the read statements against readDB and the
+// writer side against writeDB, which may be the same pool.
+func prepareStatements(readDB, writeDB *sql.DB) (*statements, error) {
+	s := &statements{}
+	for _, q := range s.queries(readDB, writeDB) {
+		stmt, err := q.db.Prepare(q.query)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	return s, nil
+}
+
+// lazyFileStatements returns the statements a handle from NewSQLiteFile
+// reads with, each prepared against db on its first use. The others stay
+// nil.
+func lazyFileStatements(db *sql.DB) *statements {
+	s := &statements{lazyDB: db, lazyPrep: make(map[**sql.Stmt]string)}
+	queries := make(map[**sql.Stmt]string)
+	for _, q := range s.queries(db, db) {
+		queries[q.stmt] = q.query
+	}
+	for _, stmt := range []**sql.Stmt{
+		&s.fileByPath, &s.fileSize, &s.chunkAt, &s.rootExists, &s.dirExists,
+		&s.fragmentRange, &s.listRoot, &s.listDir,
+	} {
+		s.lazyPrep[stmt] = queries[stmt]
+	}
+	return s
+}
+
+// get returns the read statement *stmt, preparing it first if it was left
+// to its first use by lazyFileStatements.
+func (s *statements) get(stmt **sql.Stmt) (*sql.Stmt, error) {
+	if s.lazyDB == nil {
+		return *stmt, nil
+	}
+	s.lazyMu.Lock()
+	defer s.lazyMu.Unlock()
+	if query, ok := s.lazyPrep[stmt]; ok {
+		prepared, err := s.lazyDB.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		*stmt = prepared
+		delete(s.lazyPrep, stmt)
+	}
+	if *stmt == nil {
+		return nil, errors.New("sqlitefs: statement not available to a single file")
+	}
+	return *stmt, nil
+}
+
+// queries lists every statement with its query.
+func (s *statements) queries(readDB, writeDB *sql.DB) []statementQuery {
+	return []statementQuery{
+		{readDB, &s.fileByPath, `SELECT id, type, data IS NOT NULL, data, sha256, codec, size, key_id, data_key, chunked IS NOT NULL FROM file_metadata WHERE path = ?`},
+		{writeDB, &s.fileIDByPath, `SELECT id FROM file_metadata WHERE path = ?`},
+		{readDB, &s.fileSize, `
+			SELECT COUNT(*), COALESCE((
+				SELECT LENGTH(COALESCE(b.fragment, f.fragment))
+				FROM file_fragments f
+				LEFT JOIN fragment_blobs b ON b.hash = f.blob
+				WHERE f.file_id = ?1
+				ORDER BY f.fragment_index DESC
+				LIMIT 1
+			), 0)
+			FROM file_fragments
+			WHERE file_id = ?1`},
+		{readDB, &s.blobByDigest, `SELECT file_id, size, codec, key_id, data_key, chunked IS NOT NULL, created_at FROM content_blobs WHERE digest = ?`},
+		{readDB, &s.chunkAt, `
+			SELECT fragment_index, byte_offset
+			FROM file_fragments
+			WHERE file_id = ? AND byte_offset IS NOT NULL AND byte_offset <= ?
+			ORDER BY byte_offset DESC
+			LIMIT 1`},
+		{readDB, &s.rootExists, `SELECT EXISTS(SELECT 1 FROM file_metadata)`},
+		{readDB, &s.dirExists, `SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ?)`},
+		{writeDB, &s.hasChildren, `SELECT EXISTS(SELECT 1 FROM file_metadata WHERE path LIKE ? AND path != ?)`},
+		{readDB, &s.fragmentRange, `
+			SELECT f.fragment_index, COALESCE(b.fragment, f.fragment), f.crc32c
+			FROM file_fragments f
+			LEFT JOIN fragment_blobs b ON b.hash = f.blob
+			WHERE f.file_id = ? AND f.fragment_index BETWEEN ? AND ?
+			ORDER BY f.fragment_index`},
+		{readDB, &s.scrubPage, `
+			SELECT f.file_id, f.fragment_index, COALESCE(b.fragment, f.fragment), f.crc32c, m.path
+			FROM file_fragments f
+			LEFT JOIN fragment_blobs b ON b.hash = f.blob
+			LEFT JOIN file_metadata m ON m.id = f.file_id
+			WHERE (f.file_id, f.fragment_index) > (?, ?)
+			ORDER BY f.file_id, f.fragment_index
+			LIMIT ?`},
+		{readDB, &s.listRoot, `SELECT id, path, COALESCE(size, LENGTH(data)), sha256 FROM file_metadata`},
+		{readDB, &s.listDir, `
+			SELECT id, path, COALESCE(size, LENGTH(data)), sha256
+			FROM file_metadata
+			WHERE path LIKE ? AND path != ?`},
+		{readDB, &s.pathRange, `
+			SELECT id, path, COALESCE(size, LENGTH(data)), sha256
+			FROM file_metadata
+			WHERE path >= ?1 AND (?2 IS NULL OR path < ?2)
+			ORDER BY path
+			LIMIT ?3`},
+		// '/' sorts as char(1) so a directory's contents come right after
+		// it, in the order fs.WalkDir visits them
+		{readDB, &s.walkTree, `
+			SELECT path, type, sha256, COALESCE(size, LENGTH(data), (
+				SELECT COALESCE(SUM(LENGTH(fragment)), 0)
+				FROM file_fragments
+				WHERE file_id = file_metadata.id
+			))
+			FROM file_metadata
+			WHERE path >= ?1 AND (?2 IS NULL OR path < ?2)
+			ORDER BY REPLACE(path, '/', char(1))`},
+		{writeDB, &s.insertPlaceholder, `INSERT INTO file_metadata (path, type) VALUES (?, '')`},
+		{writeDB, &s.insertFile, `INSERT OR REPLACE INTO file_metadata (id, path, type, data, sha256, codec, size, key_id, data_key, chunked) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`},
+		{writeDB, &s.insertFragment, `INSERT OR REPLACE INTO file_fragments (file_id, fragment_index, fragment, crc32c, byte_offset) VALUES (?, ?, ?, ?, ?)`},
+		{writeDB, &s.insertBlob, `INSERT OR IGNORE INTO fragment_blobs (hash, fragment) VALUES (?, ?)`},
+		{writeDB, &s.insertBlobRef, `INSERT OR REPLACE INTO file_fragments (file_id, fragment_index, fragment, crc32c, blob, byte_offset) VALUES (?, ?, x'', ?, ?, ?)`},
+		{writeDB, &s.setHash, `UPDATE file_metadata SET sha256 = ? WHERE id = ? AND sha256 IS NULL`},
+		{writeDB, &s.deleteFragments, `DELETE FROM file_fragments WHERE file_id IN (SELECT id FROM file_metadata WHERE path = ?)`},
+		{writeDB, &s.deleteFragmentsByID, `DELETE FROM file_fragments WHERE file_id = ?`},
+		{writeDB, &s.deleteFile, `DELETE FROM file_metadata WHERE path = ?`},
+		{writeDB, &s.deleteFileByID, `DELETE FROM file_metadata WHERE id = ?`},
+		{writeDB, &s.insertReclaim, `INSERT OR REPLACE INTO file_reclaim (file_id, reason, created_at, owner) VALUES (?, ?, ?, ?)`},
+		{writeDB, &s.deleteUpload, `DELETE FROM file_reclaim WHERE file_id = ? AND reason = 'upload'`},
+		{writeDB, &s.deleteReclaim, `DELETE FROM file_reclaim WHERE file_id = ?`},
+		{writeDB, &s.reclaimable, `
+			SELECT r.file_id
+			FROM file_reclaim r
+			LEFT JOIN file_instances i ON i.id = r.owner
+			WHERE CASE WHEN r.owner IS NULL THEN r.created_at < ? ELSE i.id IS NULL OR i.heartbeat < ? END`},
+	}
+}
+
+// close closes every prepared statement.
+func (s *statements) close() error {
+	s.lazyMu.Lock()
+	defer s.lazyMu.Unlock()
+	var errs []error
+	for _, stmt := range []*sql.Stmt{
+		s.fileByPath, s.fileSize, s.chunkAt, s.blobByDigest, s.rootExists, s.dirExists,
+		s.fragmentRange, s.scrubPage, s.listRoot, s.listDir, s.pathRange, s.walkTree,
+		s.fileIDByPath, s.hasChildren, s.insertPlaceholder, s.insertFile, s.insertFragment, s.insertBlob, s.insertBlobRef, s.setHash,
+		s.deleteFragments, s.deleteFragmentsByID, s.deleteFile, s.deleteFileByID,
+		s.insertReclaim, s.deleteUpload, s.deleteReclaim, s.reclaimable,
+	} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
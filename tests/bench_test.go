@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// newBenchFS creates a SQLiteFS on a private in-memory database so the
+// benchmarks measure query overhead rather than disk syncs
+func newBenchFS(b *testing.B, opts ...sqlitefs.Option) (*sqlitefs.SQLiteFS, *sql.DB) {
+	b.Helper()
+	db, err := sql.Open("sqlite", "file:"+b.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sfs, err := sqlitefs.NewSQLiteFS(db, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { sfs.Close() })
+	return sfs, db
+}
+
+func benchWriteFile(b *testing.B, sfs *sqlitefs.SQLiteFS, name string, size int) {
+	b.Helper()
+	writer := sfs.NewWriter(name)
+	writer.Write(make([]byte, size))
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkOpenStat(b *testing.B) {
+	sfs, _ := newBenchFS(b)
+	benchWriteFile(b, sfs, "assets/logo.png", 5000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.Stat(sfs, "assets/logo.png"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadSmallFile(b *testing.B) {
+	sfs, _ := newBenchFS(b)
+	benchWriteFile(b, sfs, "config.json", 200)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.ReadFile(sfs, "config.json"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewSQLiteFile(b *testing.B) {
+	sfs, db := newBenchFS(b)
+	benchWriteFile(b, sfs, "config.json", 200)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := sqlitefs.NewSQLiteFile(db, "config.json")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadAll(file); err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+}
+
+func BenchmarkReadLargeFile(b *testing.B) {
+	const size = 4 * 1024 * 1024
+	sfs, _ := newBenchFS(b)
+	benchWriteFile(b, sfs, "video.bin", size)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := sfs.Open("video.bin")
+		if err != nil {
+			b.Fatal(err)
+		}
+		// 16 KiB reads mirror a typical fragment-sized consumer
+		buf := make([]byte, 16*1024)
+		for {
+			_, err := file.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		file.Close()
+	}
+}
+
+func BenchmarkWriteFile(b *testing.B) {
+	const size = 1024 * 1024
+	sfs, _ := newBenchFS(b)
+	data := make([]byte, size)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer := sfs.NewWriter(fmt.Sprintf("upload-%d.bin", i%8))
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	sfs, _ := newBenchFS(b)
+	for i := 0; i < 200; i++ {
+		benchWriteFile(b, sfs, fmt.Sprintf("dir/file-%03d.txt", i), 100)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.ReadDir(sfs, "dir"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestBlobs tests content-addressed blobs: storing them by digest, reading
+// them back and binding them to paths without storing them again
+func TestBlobs(t *testing.T) {
+	data := make([]byte, 50*1024) // 4 fragments
+	rand.New(rand.NewSource(1)).Read(data)
+	sum := sha256.Sum256(data)
+
+	put := func(t *testing.T, sfs *sqlitefs.SQLiteFS, data []byte) []byte {
+		t.Helper()
+		digest, err := sfs.PutBlob(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("PutBlob: %v", err)
+		}
+		return digest
+	}
+
+	t.Run("PutOpen", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+
+		digest := put(t, sfs, data)
+		if !bytes.Equal(digest, sum[:]) {
+			t.Fatalf("Expected digest %x, got %x", sum, digest)
+		}
+		if again := put(t, sfs, data); !bytes.Equal(again, digest) {
+			t.Errorf("Expected the same digest again, got %x", again)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM content_blobs"); n != 1 {
+			t.Errorf("Expected one blob, got %d", n)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 4 {
+			t.Errorf("Expected the second copy to be dropped, got %d fragments", n)
+		}
+
+		file, err := sfs.OpenBlob(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if content, err := io.ReadAll(file); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the content back: %v", err)
+		}
+		buf := make([]byte, 1000)
+		if _, err := file.(io.ReaderAt).ReadAt(buf, 16*1024-500); err != nil || !bytes.Equal(buf, data[16*1024-500:16*1024+500]) {
+			t.Errorf("ReadAt across fragments: %v", err)
+		}
+		info, err := file.Stat()
+		if err != nil || info.Name() != hex.EncodeToString(digest) || info.Size() != int64(len(data)) || info.IsDir() {
+			t.Errorf("Unexpected blob info %v: %v", info, err)
+		}
+
+		empty := put(t, sfs, nil)
+		file, err = sfs.OpenBlob(empty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if content, err := io.ReadAll(file); err != nil || len(content) != 0 {
+			t.Errorf("Expected an empty blob: %q, %v", content, err)
+		}
+	})
+
+	t.Run("Bind", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		digest := put(t, sfs, data)
+
+		paths := []string{"mirror/a/pkg-1.0.tgz", "mirror/b/pkg-1.0.tgz", "cache/pkg.tgz"}
+		for _, path := range paths {
+			if err := sfs.BindBlob(path, digest); err != nil {
+				t.Fatalf("BindBlob %s: %v", path, err)
+			}
+		}
+		for _, path := range paths {
+			if content, err := fs.ReadFile(sfs, path); err != nil || !bytes.Equal(content, data) {
+				t.Errorf("Expected the content of %s: %v", path, err)
+			}
+			if h, err := sfs.Hash(path); err != nil || !bytes.Equal(h, digest) {
+				t.Errorf("Expected %s to have the blob's digest, got %x: %v", path, h, err)
+			}
+		}
+		if s, err := sfs.DedupStats(); err != nil || s.Blobs != 4 || s.References != 16 {
+			t.Errorf("Expected 16 references to the 4 fragments of the blob, got %+v: %v", s, err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+
+		// Paths and the blob are independent of each other
+		file, err := sfs.OpenBlob(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sfs.RemoveBlob(digest); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := io.ReadAll(file); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected an open blob to stay readable: %v", err)
+		}
+		file.Close()
+		if _, err := sfs.OpenBlob(digest); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected the blob to be gone, got %v", err)
+		}
+		if content, err := fs.ReadFile(sfs, paths[0]); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected bound paths to keep their content: %v", err)
+		}
+		for _, path := range paths {
+			if err := sfs.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := countRows(t, db, "SELECT (SELECT COUNT(*) FROM file_fragments) + (SELECT COUNT(*) FROM fragment_blobs)"); n != 0 {
+			t.Errorf("Expected everything to be released, %d rows left", n)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		sfs, _ := newTestFS(t)
+		unknown := make([]byte, sha256.Size)
+
+		if _, err := sfs.OpenBlob(unknown); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected OpenBlob to fail with ErrNotExist, got %v", err)
+		}
+		if err := sfs.BindBlob("a.bin", unknown); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected BindBlob to fail with ErrNotExist, got %v", err)
+		}
+		if _, err := fs.Stat(sfs, "a.bin"); err == nil {
+			t.Error("Expected nothing to be bound")
+		}
+		if err := sfs.RemoveBlob(unknown); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected RemoveBlob to fail with ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("FailingReader", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+
+		broken := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(io.ErrUnexpectedEOF))
+		if _, err := sfs.PutBlob(broken); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected the read error, got %v", err)
+		}
+		if n := countRows(t, db, "SELECT (SELECT COUNT(*) FROM content_blobs) + (SELECT COUNT(*) FROM file_fragments)"); n != 0 {
+			t.Errorf("Expected nothing to be stored, %d rows left", n)
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		digest := put(t, sfs, data)
+		other := put(t, sfs, data[:20000])
+		if err := sfs.BindBlob("a.bin", digest); err != nil {
+			t.Fatalf("BindBlob: %v", err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 || report.Blobs != 2 {
+			t.Fatalf("Expected two clean blobs: %+v, %v", report, err)
+		}
+
+		// One blob's content no longer matches its digest, the other's size
+		wrong := sha256.Sum256([]byte("something else"))
+		if _, err := db.Exec("UPDATE content_blobs SET digest = ? WHERE digest = ?", wrong[:], digest); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE content_blobs SET size = size + 1 WHERE digest = ?", other); err != nil {
+			t.Fatal(err)
+		}
+		report, err := sfs.Repair(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 2 {
+			t.Fatalf("Expected two damaged blobs, got %v", report.Problems)
+		}
+		for _, p := range report.Problems {
+			switch {
+			case p.Kind == sqlitefs.ProblemHashMismatch && bytes.Equal(p.Blob, wrong[:]):
+			case p.Kind == sqlitefs.ProblemSizeMismatch && bytes.Equal(p.Blob, other):
+			default:
+				t.Errorf("Unexpected problem %v", p)
+			}
+			if p.Path != "" || p.Action != "blob removed" {
+				t.Errorf("Expected the blob to be removed, got %v", p)
+			}
+		}
+
+		if _, err := sfs.OpenBlob(other); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected the damaged blob to be gone, got %v", err)
+		}
+		if content, err := fs.ReadFile(sfs, "a.bin"); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the bound path to keep its content: %v", err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check after Repair: %v, %v", report.Problems, err)
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		keys := sqlitefs.StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 32)}}
+		dbPath := filepath.Join(t.TempDir(), "blobs.db")
+		open := func(keys sqlitefs.KeyProvider) *sqlitefs.SQLiteFS {
+			sfs, _ := openTestFS(t, dbPath, sqlitefs.WithEncryption(keys))
+			t.Cleanup(func() { sfs.Close() })
+			return sfs
+		}
+		sfs := open(keys)
+
+		digest := put(t, sfs, data)
+		for _, path := range []string{"a.bin", "b.bin"} {
+			if err := sfs.BindBlob(path, digest); err != nil {
+				t.Fatalf("BindBlob %s: %v", path, err)
+			}
+		}
+		for _, path := range []string{"a.bin", "b.bin"} {
+			if content, err := fs.ReadFile(sfs, path); err != nil || !bytes.Equal(content, data) {
+				t.Errorf("Expected the content of %s: %v", path, err)
+			}
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+
+		rotated := keys
+		rotated.Current = "k2"
+		sfs2 := open(rotated)
+		if n, err := sfs2.RotateKeys(context.Background()); err != nil || n != 3 {
+			t.Errorf("Expected the blob and both files to be re-wrapped, got %d: %v", n, err)
+		}
+		file, err := sfs2.OpenBlob(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if content, err := io.ReadAll(file); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the blob to read after rotation: %v", err)
+		}
+	})
+}
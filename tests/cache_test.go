@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestFragmentCache tests the shared LRU fragment cache
+func TestFragmentCache(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithFragmentCache(1<<20))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	writeFile := func(name string, data []byte) {
+		t.Helper()
+		writer := fs.NewWriter(name)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+	}
+	readFile := func(name string) []byte {
+		t.Helper()
+		file, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return data
+	}
+
+	logo := bytes.Repeat([]byte("logo"), 10000) // 3 fragments
+	writeFile("logo.png", logo)
+
+	t.Run("SharedAcrossHandles", func(t *testing.T) {
+		if got := readFile("logo.png"); !bytes.Equal(got, logo) {
+			t.Fatal("Content mismatch on first read")
+		}
+		first := fs.CacheStats()
+		if first.Misses != 3 {
+			t.Errorf("Expected 3 misses after first read, got %d", first.Misses)
+		}
+
+		if got := readFile("logo.png"); !bytes.Equal(got, logo) {
+			t.Fatal("Content mismatch on cached read")
+		}
+		second := fs.CacheStats()
+		if second.Misses != first.Misses {
+			t.Errorf("Expected no new misses, got %d", second.Misses-first.Misses)
+		}
+		if second.Hits < 3 {
+			t.Errorf("Expected at least 3 hits, got %d", second.Hits)
+		}
+		if second.Entries != 3 {
+			t.Errorf("Expected 3 cached fragments, got %d", second.Entries)
+		}
+	})
+
+	t.Run("InvalidatedOnOverwrite", func(t *testing.T) {
+		updated := bytes.Repeat([]byte("LOGO"), 9000)
+		writeFile("logo.png", updated)
+
+		if got := readFile("logo.png"); !bytes.Equal(got, updated) {
+			t.Fatal("Stale content served after overwrite")
+		}
+		if stats := fs.CacheStats(); stats.Entries != 3 {
+			t.Errorf("Expected old fragments to be dropped, got %d entries", stats.Entries)
+		}
+	})
+
+	t.Run("InvalidatedOnRemove", func(t *testing.T) {
+		if err := fs.Remove("logo.png"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if stats := fs.CacheStats(); stats.Entries != 0 {
+			t.Errorf("Expected empty cache after remove, got %d entries", stats.Entries)
+		}
+		if _, err := fs.Open("logo.png"); err == nil {
+			t.Error("Expected error opening removed file")
+		}
+	})
+
+	t.Run("BoundedMemory", func(t *testing.T) {
+		db2, err := sql.Open("sqlite", "file:fragmentcache_small?mode=memory&cache=shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db2.Close()
+
+		small, err := sqlitefs.NewSQLiteFS(db2, sqlitefs.WithFragmentCache(40*1024))
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		defer small.Close()
+
+		data := make([]byte, 16*1024*6)
+		for i := range data {
+			data[i] = byte(i / 1000)
+		}
+		writer := small.NewWriter("big.bin")
+		writer.Write(data)
+		writer.Close()
+
+		got, err := io.ReadAll(mustOpen(t, small, "big.bin"))
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("Content mismatch with small cache")
+		}
+
+		stats := small.CacheStats()
+		if stats.Bytes > 40*1024 {
+			t.Errorf("Cache exceeded its budget: %d bytes", stats.Bytes)
+		}
+		if stats.Evictions == 0 {
+			t.Error("Expected evictions with a small cache")
+		}
+	})
+}
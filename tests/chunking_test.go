@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestChunking tests content-defined chunking: boundaries follow the
+// content, reads find chunks through their offsets and edits leave the
+// chunks away from them unchanged
+func TestChunking(t *testing.T) {
+	chunking := sqlitefs.Chunking{Min: 2 << 10, Avg: 8 << 10, Max: 32 << 10}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	withChunking := sqlitefs.WithChunking(chunking)
+	// write stores data in pieces of step bytes
+	write := func(t *testing.T, sfs *sqlitefs.SQLiteFS, path string, data []byte, step int, opts ...sqlitefs.WriterOption) {
+		t.Helper()
+		writer := sfs.NewWriter(path, opts...)
+		for len(data) > 0 {
+			n := min(step, len(data))
+			if _, err := writer.Write(data[:n]); err != nil {
+				t.Fatalf("Failed to write %s: %v", path, err)
+			}
+			data = data[n:]
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close %s: %v", path, err)
+		}
+	}
+	// chunks returns the stored offset and length of each chunk of path
+	chunks := func(t *testing.T, db *sql.DB, path string) [][2]int64 {
+		t.Helper()
+		rows, err := db.Query(`
+			SELECT f.byte_offset, LENGTH(COALESCE(b.fragment, f.fragment))
+			FROM file_fragments f
+			JOIN file_metadata m ON m.id = f.file_id
+			LEFT JOIN fragment_blobs b ON b.hash = f.blob
+			WHERE m.path = ?
+			ORDER BY f.fragment_index`, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var result [][2]int64
+		for rows.Next() {
+			var offset sql.NullInt64
+			var length int64
+			if err := rows.Scan(&offset, &length); err != nil {
+				t.Fatal(err)
+			}
+			if !offset.Valid {
+				t.Fatalf("Expected every chunk of %s to have an offset", path)
+			}
+			result = append(result, [2]int64{offset.Int64, length})
+		}
+		return result
+	}
+
+	t.Run("Boundaries", func(t *testing.T) {
+		sfs, db := newTestFS(t, withChunking)
+		write(t, sfs, "a.bin", data, 1000)
+		write(t, sfs, "b.bin", data, 1<<20)
+
+		a := chunks(t, db, "a.bin")
+		if len(a) < len(data)/(2*chunking.Avg) || len(a) > len(data)/chunking.Min {
+			t.Errorf("Expected around %d chunks, got %d", len(data)/chunking.Avg, len(a))
+		}
+		var offset int64
+		for i, chunk := range a {
+			if chunk[0] != offset {
+				t.Fatalf("Expected chunk %d at offset %d, got %d", i, offset, chunk[0])
+			}
+			if chunk[1] > int64(chunking.Max) || (chunk[1] < int64(chunking.Min) && i < len(a)-1) {
+				t.Errorf("Chunk %d has %d bytes, outside [%d, %d]", i, chunk[1], chunking.Min, chunking.Max)
+			}
+			offset += chunk[1]
+		}
+		if offset != int64(len(data)) {
+			t.Errorf("Expected chunks to cover %d bytes, got %d", len(data), offset)
+		}
+
+		// Boundaries depend on the content only, not on how it was written
+		if b := chunks(t, db, "b.bin"); len(b) != len(a) || b[len(b)/2] != a[len(a)/2] {
+			t.Error("Expected the same boundaries for the same content")
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts []sqlitefs.Option
+	}{
+		{"Direct", nil},
+		{"ReadAhead", []sqlitefs.Option{sqlitefs.WithReadAhead(4)}},
+		{"FragmentCache", []sqlitefs.Option{sqlitefs.WithFragmentCache(1 << 20)}},
+	} {
+		t.Run("Read"+tc.name, func(t *testing.T) {
+			sfs, _ := newTestFS(t, append(tc.opts, withChunking)...)
+			write(t, sfs, "a.bin", data, 4096)
+
+			if info, err := fs.Stat(sfs, "a.bin"); err != nil || info.Size() != int64(len(data)) {
+				t.Errorf("Expected size %d: %v", len(data), err)
+			}
+			if content, err := io.ReadAll(mustOpen(t, sfs, "a.bin")); err != nil || !bytes.Equal(content, data) {
+				t.Fatalf("Expected the content back: %v", err)
+			}
+
+			// Small sequential reads cross chunk boundaries
+			file := mustOpen(t, sfs, "a.bin")
+			var content []byte
+			buf := make([]byte, 3000)
+			for {
+				n, err := file.Read(buf)
+				content = append(content, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(content, data) {
+				t.Error("Expected small reads to return the content")
+			}
+
+			file = mustOpen(t, sfs, "a.bin")
+			rng := rand.New(rand.NewSource(2))
+			for range 50 {
+				off := rng.Int63n(int64(len(data)))
+				buf := make([]byte, min(1+rng.Intn(40000), len(data)-int(off)))
+				if n, err := file.(io.ReaderAt).ReadAt(buf, off); err != nil || !bytes.Equal(buf[:n], data[off:off+int64(n)]) || n != len(buf) {
+					t.Fatalf("ReadAt(%d, %d) returned %d bytes: %v", len(buf), off, n, err)
+				}
+			}
+
+			off := int64(len(data) - 100000)
+			if _, err := file.(io.Seeker).Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if _, err := io.Copy(&out, file); err != nil || !bytes.Equal(out.Bytes(), data[off:]) {
+				t.Errorf("Expected the content after %d: %v", off, err)
+			}
+		})
+	}
+
+	t.Run("Deduplication", func(t *testing.T) {
+		sfs, db := newTestFS(t, withChunking, sqlitefs.WithDeduplication())
+		write(t, sfs, "v1.bin", data, 8192)
+		write(t, sfs, "v2.bin", append([]byte("inserted"), data...), 8192)
+
+		s, err := sfs.DedupStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1 := int64(len(chunks(t, db, "v1.bin")))
+		if s.Blobs > v1+3 || s.StoredBytes > int64(len(data))+2*int64(chunking.Max) {
+			t.Errorf("Expected the second version to share all but a few of %d chunks, got %+v", v1, s)
+		}
+		if content, err := fs.ReadFile(sfs, "v2.bin"); err != nil || !bytes.Equal(content[8:], data) {
+			t.Errorf("Expected the content of v2.bin back: %v", err)
+		}
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		sfs, _ := newTestFS(t, withChunking)
+		text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000))
+		write(t, sfs, "a.txt", text, 5000, sqlitefs.WithFileCodec(sqlitefs.Flate(5)))
+
+		file := mustOpen(t, sfs, "a.txt")
+		buf := make([]byte, 1000)
+		if _, err := file.(io.ReaderAt).ReadAt(buf, 100000); err != nil || !bytes.Equal(buf, text[100000:101000]) {
+			t.Errorf("ReadAt in a compressed chunked file: %v", err)
+		}
+		if content, err := fs.ReadFile(sfs, "a.txt"); err != nil || !bytes.Equal(content, text) {
+			t.Errorf("Expected the content back: %v", err)
+		}
+	})
+
+	t.Run("FileOption", func(t *testing.T) {
+		sfs, db := newTestFS(t, withChunking)
+		write(t, sfs, "fixed.bin", data, 8192, sqlitefs.WithFileChunking(sqlitefs.Chunking{}))
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE byte_offset IS NOT NULL"); n != 0 {
+			t.Errorf("Expected fixed fragments without offsets, got %d", n)
+		}
+		if content, err := fs.ReadFile(sfs, "fixed.bin"); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the content back: %v", err)
+		}
+
+		writer := sfs.NewWriter("bad.bin", sqlitefs.WithFileChunking(sqlitefs.Chunking{Min: 4096, Avg: 1024, Max: 8192}))
+		if _, err := writer.Write(data); err == nil {
+			t.Error("Expected invalid chunking to fail the writer")
+		}
+		if err := writer.Close(); err == nil {
+			t.Error("Expected Close to fail as well")
+		}
+		if _, err := sfs.Open("bad.bin"); err == nil {
+			t.Error("Expected nothing to be committed")
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		sfs, db := newTestFS(t, withChunking)
+		write(t, sfs, "a.bin", data, 8192)
+		write(t, sfs, "b.bin", data, 8192)
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Fatalf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+
+		a := chunks(t, db, "a.bin")
+		_, err := db.Exec(`UPDATE file_fragments SET byte_offset = byte_offset + 1
+			WHERE fragment_index = 3 AND file_id = (SELECT id FROM file_metadata WHERE path = 'a.bin')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`DELETE FROM file_fragments
+			WHERE fragment_index = 5 AND file_id = (SELECT id FROM file_metadata WHERE path = 'b.bin')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := sfs.Repair(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 2 || report.Problems[0].Kind != sqlitefs.ProblemFragmentSize || report.Problems[1].Kind != sqlitefs.ProblemGap {
+			t.Fatalf("Expected a misplaced and a missing chunk, got %v", report.Problems)
+		}
+
+		// b.bin keeps the chunks before the gap
+		content, err := fs.ReadFile(sfs, "b.bin")
+		if err != nil || !bytes.Equal(content, data[:a[5][0]]) {
+			t.Errorf("Expected b.bin to be truncated to %d bytes, got %d: %v", a[5][0], len(content), err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check after Repair: %v, %v", report.Problems, err)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// upperCodec is a custom codec that is not built in
+type upperCodec struct{}
+
+func (upperCodec) Name() string { return "upper" }
+
+func (upperCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, bytes.ToUpper(src)...), nil
+}
+
+func (upperCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, bytes.ToLower(src)...), nil
+}
+
+// TestCompression tests that fragments are compressed by MIME type and read
+// back transparently
+func TestCompression(t *testing.T) {
+	text := []byte(strings.Repeat("compressible text, ", 5000)) // 6 fragments
+	storedBytes := func(t *testing.T, db *sql.DB, path string) (int, string) {
+		t.Helper()
+		var n int
+		var codec *string
+		err := db.QueryRow(`SELECT COALESCE(SUM(LENGTH(f.fragment)), 0), m.codec
+			FROM file_metadata m LEFT JOIN file_fragments f ON f.file_id = m.id
+			WHERE m.path = ? GROUP BY m.id`, path).Scan(&n, &codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec == nil {
+			return n, ""
+		}
+		return n, *codec
+	}
+
+	for _, codec := range []sqlitefs.Codec{sqlitefs.Gzip(6), sqlitefs.Flate(1)} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			sfs, db := newTestFS(t, sqlitefs.WithCompression(codec, "text/*", "application/json"))
+
+			writeFile(t, sfs, "docs/a.txt", text)
+			writeFile(t, sfs, "docs/b.bin", text)
+			if n, name := storedBytes(t, db, "docs/a.txt"); n >= len(text)/4 || name != codec.Name() {
+				t.Errorf("Expected a.txt compressed with %s, got %d bytes with %q", codec.Name(), n, name)
+			}
+			if n, name := storedBytes(t, db, "docs/b.bin"); n != len(text) || name != "" {
+				t.Errorf("Expected b.bin stored as it is, got %d bytes with %q", n, name)
+			}
+
+			if content, err := io.ReadAll(mustOpen(t, sfs, "docs/a.txt")); err != nil || !bytes.Equal(content, text) {
+				t.Fatalf("Expected the original content back: %v", err)
+			}
+			file := mustOpen(t, sfs, "docs/a.txt")
+			buf := make([]byte, 1000)
+			off := int64(16*1024 - 300) // across a fragment boundary
+			if _, err := file.(io.ReaderAt).ReadAt(buf, off); err != nil || !bytes.Equal(buf, text[off:off+1000]) {
+				t.Errorf("ReadAt across fragments: %v", err)
+			}
+			if _, err := file.(io.Seeker).Seek(3*16*1024+5, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(file, buf); err != nil || !bytes.Equal(buf, text[3*16*1024+5:3*16*1024+1005]) {
+				t.Errorf("Read after Seek: %v", err)
+			}
+
+			// Sizes are those of the original content
+			if info, err := fs.Stat(sfs, "docs/a.txt"); err != nil || info.Size() != int64(len(text)) {
+				t.Errorf("Expected Stat size %d: %v", len(text), err)
+			}
+			entries, err := fs.ReadDir(sfs, "docs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if info, _ := entry.Info(); info.Size() != int64(len(text)) {
+					t.Errorf("Expected ReadDir size %d for %s, got %d", len(text), entry.Name(), info.Size())
+				}
+			}
+			err = sfs.WalkDir("docs", func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				if info, _ := d.Info(); info.Size() != int64(len(text)) {
+					t.Errorf("Expected WalkDir size %d for %s, got %d", len(text), path, info.Size())
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("Cache", func(t *testing.T) {
+		for _, opt := range []sqlitefs.Option{sqlitefs.WithReadAhead(2), sqlitefs.WithFragmentCache(1 << 20)} {
+			sfs, _ := newTestFS(t, opt, sqlitefs.WithCompression(sqlitefs.Flate(5)))
+			writeFile(t, sfs, "a.txt", text)
+			for range 2 {
+				if content, err := io.ReadAll(mustOpen(t, sfs, "a.txt")); err != nil || !bytes.Equal(content, text) {
+					t.Errorf("Expected the original content back: %v", err)
+				}
+			}
+		}
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		sfs, db := newTestFS(t,
+			sqlitefs.WithCompression(sqlitefs.Flate(9), "application/json"),
+			sqlitefs.WithCompression(sqlitefs.Gzip(1)))
+
+		writeFile(t, sfs, "a.json", text)
+		writeFile(t, sfs, "a.txt", text)
+		writeFile(t, sfs, "a.png", text)
+		writeFile(t, sfs, "b.json", text, sqlitefs.WithFileCodec(nil))
+		writeFile(t, sfs, "c.png", text, sqlitefs.WithFileCodec(sqlitefs.Flate(1)))
+		for path, want := range map[string]string{"a.json": "flate", "a.txt": "gzip", "a.png": "", "b.json": "", "c.png": "flate"} {
+			if _, name := storedBytes(t, db, path); name != want {
+				t.Errorf("Expected %s stored with %q, got %q", path, want, name)
+			}
+			if content, err := io.ReadAll(mustOpen(t, sfs, path)); err != nil || !bytes.Equal(content, text) {
+				t.Errorf("Expected the original content of %s back: %v", path, err)
+			}
+		}
+
+		writer := sfs.NewWriter("d.txt", sqlitefs.WithFileCodec(upperCodec{}))
+		_, err := writer.Write(text)
+		if err := errors.Join(err, writer.Close()); err == nil {
+			t.Error("Expected a codec the filesystem does not know to be rejected")
+		}
+	})
+
+	t.Run("CustomCodec", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "codec.db")
+
+		sfs, _ := openTestFS(t, path, sqlitefs.WithCompression(upperCodec{}, "text/plain"))
+		writeFile(t, sfs, "a.txt", text)
+		sfs.Close()
+
+		sfs, _ = openTestFS(t, path)
+		if _, err := sfs.Open("a.txt"); err == nil {
+			t.Error("Expected opening a file with an unknown codec to fail")
+		}
+		sfs.Close()
+
+		sfs, db := openTestFS(t, path, sqlitefs.WithCodec(upperCodec{}))
+		defer sfs.Close()
+		if content, err := io.ReadAll(mustOpen(t, sfs, "a.txt")); err != nil || !bytes.Equal(content, text) {
+			t.Errorf("Expected the original content back: %v", err)
+		}
+		writeFile(t, sfs, "b.txt", text)
+		if _, name := storedBytes(t, db, "b.txt"); name != "" {
+			t.Errorf("Expected WithCodec not to compress new files, got %q", name)
+		}
+	})
+
+	t.Run("Integrity", func(t *testing.T) {
+		sfs, db := newTestFS(t, sqlitefs.WithCompression(sqlitefs.Gzip(6)))
+		writeFile(t, sfs, "a.txt", text)
+		writeFile(t, sfs, "b.txt", text)
+
+		sum, err := sfs.Hash("a.txt")
+		if want := sha256.Sum256(text); err != nil || !bytes.Equal(sum, want[:]) {
+			t.Errorf("Expected the digest of the original content: %v", err)
+		}
+		if report, err := sfs.Scrub(context.Background()); err != nil || len(report.Damaged) != 0 {
+			t.Errorf("Expected a clean scrub: %+v, %v", report, err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+
+		// Fragments that cannot be decompressed, with checksums to match
+		_, err = db.Exec(`UPDATE file_fragments SET fragment = x'0102030405', crc32c = NULL
+			WHERE file_id = (SELECT id FROM file_metadata WHERE path = 'b.txt') AND fragment_index = 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(mustOpen(t, sfs, "b.txt")); err == nil {
+			t.Error("Expected reading an undecodable fragment to fail")
+		}
+		report, err := sfs.Check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 1 || report.Problems[0].Kind != sqlitefs.ProblemCorrupt || report.Problems[0].Index != 1 {
+			t.Errorf("Expected fragment 1 of b.txt to be reported, got %v", report.Problems)
+		}
+	})
+}
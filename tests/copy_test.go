@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// patternReader yields n bytes of a repeating pattern without holding them
+type patternReader struct {
+	n, pos int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.pos >= r.n {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.n-r.pos)]
+	for i := range p {
+		p[i] = byte((r.pos + int64(i)) % 251)
+	}
+	r.pos += int64(len(p))
+	return len(p), nil
+}
+
+// TestCopyFastPaths tests io.Copy through WriteTo and ReadFrom
+func TestCopyFastPaths(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:copyfastpaths?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db)
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	const size = 8*1024*1024 + 12345
+
+	t.Run("ReadFrom", func(t *testing.T) {
+		writer := fs.NewWriter("copied.bin")
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		n, err := io.Copy(writer, &patternReader{n: size})
+		runtime.ReadMemStats(&after)
+
+		if err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+		if n != size {
+			t.Errorf("Expected %d bytes copied, got %d", size, n)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		// The writer itself only needs a handful of fragment buffers
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/2 {
+			t.Errorf("Copy allocated %d bytes for a %d byte file", alloc, size)
+		}
+	})
+
+	t.Run("WriteTo", func(t *testing.T) {
+		file, err := fs.Open("copied.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+
+		// Skip into the middle of a fragment first
+		file.(*sqlitefs.SQLiteFile).Seek(100, io.SeekStart)
+
+		var out bytes.Buffer
+		n, err := io.Copy(&out, file)
+		if err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+		if n != size-100 {
+			t.Errorf("Expected %d bytes copied, got %d", size-100, n)
+		}
+
+		expected, _ := io.ReadAll(&patternReader{n: size})
+		if !bytes.Equal(out.Bytes(), expected[100:]) {
+			t.Error("Content mismatch after WriteTo")
+		}
+
+		// A second copy has nothing left to write
+		n, err = io.Copy(io.Discard, file)
+		if n != 0 || err != nil {
+			t.Errorf("Expected empty copy at EOF, got %d, %v", n, err)
+		}
+	})
+
+	t.Run("FileToFile", func(t *testing.T) {
+		src, err := fs.Open("copied.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer src.Close()
+
+		writer := fs.NewWriter("copy2.bin")
+		if _, err := io.Copy(writer, src); err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		got, err := io.ReadAll(mustOpen(t, fs, "copy2.bin"))
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		expected, _ := io.ReadAll(&patternReader{n: size})
+		if !bytes.Equal(got, expected) {
+			t.Error("Content mismatch after file to file copy")
+		}
+	})
+
+	t.Run("LargeSingleWrite", func(t *testing.T) {
+		data, _ := io.ReadAll(&patternReader{n: 3*16*1024 + 7})
+		writer := fs.NewWriter("single.bin")
+		n, err := writer.Write(data)
+		if err != nil || n != len(data) {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		got, _ := io.ReadAll(mustOpen(t, fs, "single.bin"))
+		if !bytes.Equal(got, data) {
+			t.Error("Content mismatch after single large write")
+		}
+	})
+}
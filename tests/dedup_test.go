@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestDeduplication tests that identical fragments are stored once and
+// released with the last file referring to them
+func TestDeduplication(t *testing.T) {
+	const fragment = 16 * 1024
+	shared := bytes.Repeat([]byte("vendored library "), 5*fragment/17+1)[:5*fragment] // 5 fragments
+	edited := append(bytes.Clone(shared[:2*fragment]), bytes.Repeat([]byte("x"), fragment+100)...)
+
+	setup := func(t *testing.T, opts ...sqlitefs.Option) (*sqlitefs.SQLiteFS, *sql.DB) {
+		t.Helper()
+		sfs, db := newTestFS(t, append(opts, sqlitefs.WithDeduplication())...)
+		for path, data := range map[string][]byte{"a.js": shared, "b.js": shared, "c.js": edited} {
+			writeFile(t, sfs, path, data)
+		}
+		return sfs, db
+	}
+	stats := func(t *testing.T, sfs *sqlitefs.SQLiteFS) sqlitefs.DedupStats {
+		t.Helper()
+		s, err := sfs.DedupStats()
+		if err != nil {
+			t.Fatalf("DedupStats: %v", err)
+		}
+		return s
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		sfs, db := setup(t)
+
+		// Five fragments of shared, plus the two tails of edited
+		s := stats(t, sfs)
+		want := sqlitefs.DedupStats{References: 14, Blobs: 7, LogicalBytes: 13*fragment + 100, StoredBytes: 6*fragment + 100}
+		if s != want {
+			t.Errorf("Expected %+v, got %+v", want, s)
+		}
+		if s.Ratio() <= 1.5 {
+			t.Errorf("Expected a dedup ratio above 1.5, got %.2f", s.Ratio())
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE LENGTH(fragment) > 0"); n != 0 {
+			t.Errorf("Expected no fragment content outside fragment_blobs, got %d rows", n)
+		}
+
+		// Files are closed again so nothing keeps replaced versions alive
+		for path, data := range map[string][]byte{"a.js": shared, "b.js": shared, "c.js": edited} {
+			if content, err := fs.ReadFile(sfs, path); err != nil || !bytes.Equal(content, data) {
+				t.Errorf("Expected the content of %s back: %v", path, err)
+			}
+		}
+		file := mustOpen(t, sfs, "c.js")
+		buf := make([]byte, 300)
+		if _, err := file.(io.ReaderAt).ReadAt(buf, 2*fragment-150); err != nil || !bytes.Equal(buf, edited[2*fragment-150:2*fragment+150]) {
+			t.Errorf("ReadAt across a shared and an own fragment: %v", err)
+		}
+		file.Close()
+
+		// Replacing and removing files releases their references
+		writeFile(t, sfs, "a.js", []byte("replaced"))
+		if s := stats(t, sfs); s.References != 10 || s.Blobs != 8 {
+			t.Errorf("Expected 10 references to 8 blobs after the overwrite, got %+v", s)
+		}
+		if err := sfs.Remove("b.js"); err != nil {
+			t.Fatal(err)
+		}
+		if s := stats(t, sfs); s.References != 5 || s.Blobs != 5 {
+			t.Errorf("Expected 5 references to 5 blobs after Remove, got %+v", s)
+		}
+		if content, err := fs.ReadFile(sfs, "c.js"); err != nil || !bytes.Equal(content, edited) {
+			t.Errorf("Expected c.js to be intact: %v", err)
+		}
+		for _, path := range []string{"a.js", "c.js"} {
+			if err := sfs.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM fragment_blobs"); n != 0 {
+			t.Errorf("Expected every blob to be released, %d left", n)
+		}
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		sfs, _ := setup(t, sqlitefs.WithCompression(sqlitefs.Flate(5), "text/javascript"))
+		if s := stats(t, sfs); s.References != 14 || s.Blobs != 7 || s.StoredBytes >= 2*fragment {
+			t.Errorf("Expected 7 small compressed blobs, got %+v", s)
+		}
+		if content, err := io.ReadAll(mustOpen(t, sfs, "b.js")); err != nil || !bytes.Equal(content, shared) {
+			t.Errorf("Expected the content back: %v", err)
+		}
+	})
+
+	t.Run("Integrity", func(t *testing.T) {
+		sfs, db := setup(t)
+
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Fatalf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+
+		// A damaged blob shows in every file referring to it
+		_, err := db.Exec(`UPDATE fragment_blobs SET fragment = zeroblob(LENGTH(fragment))
+			WHERE hash = (SELECT blob FROM file_fragments WHERE fragment_index = 0 LIMIT 1)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"a.js", "b.js", "c.js"} {
+			if _, err := io.ReadAll(mustOpen(t, sfs, path)); !errors.Is(err, sqlitefs.ErrCorrupt) {
+				t.Errorf("Expected %s to report the damage, got %v", path, err)
+			}
+		}
+		report, err := sfs.Scrub(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Fragments != 14 || len(report.Damaged) != 3 || report.Unverified != 0 {
+			t.Errorf("Expected 3 of 14 fragments damaged, got %+v", report)
+		}
+	})
+
+	t.Run("Repair", func(t *testing.T) {
+		sfs, db := setup(t)
+
+		if _, err := db.Exec(`UPDATE fragment_blobs SET refs = refs + 1`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO fragment_blobs (hash, fragment, refs) VALUES (zeroblob(32), x'00', 2)`); err != nil {
+			t.Fatal(err)
+		}
+		report, err := sfs.Check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 8 {
+			t.Fatalf("Expected 8 blob problems, got %v", report.Problems)
+		}
+		for _, p := range report.Problems {
+			if p.Kind != sqlitefs.ProblemBlobRefs || len(p.Blob) != 32 {
+				t.Errorf("Expected a blob reference problem, got %v", p)
+			}
+		}
+
+		if _, err := sfs.Repair(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check after Repair: %v, %v", report.Problems, err)
+		}
+		if s := stats(t, sfs); s.References != 14 || s.Blobs != 7 {
+			t.Errorf("Expected the unreferenced blob to be deleted, got %+v", s)
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		keys := sqlitefs.StaticKeys{Current: "k", Keys: map[string][]byte{"k": bytes.Repeat([]byte{9}, 32)}}
+		sfs, _ := setup(t, sqlitefs.WithEncryption(keys))
+		if s := stats(t, sfs); s.References != 0 {
+			t.Errorf("Expected encrypted files not to be deduplicated, got %+v", s)
+		}
+		if content, err := io.ReadAll(mustOpen(t, sfs, "c.js")); err != nil || !bytes.Equal(content, edited) {
+			t.Errorf("Expected the content back: %v", err)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestEncryption tests that fragments are stored encrypted, read back
+// transparently and survive master key rotation
+func TestEncryption(t *testing.T) {
+	text := []byte(strings.Repeat("confidential customer document ", 2000)) // 4 fragments
+	keys := sqlitefs.StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+
+	dbPath := func(t *testing.T) string {
+		return filepath.Join(t.TempDir(), "encrypted.db")
+	}
+	// fragments returns the stored fragments of all files, concatenated
+	fragments := func(t *testing.T, db *sql.DB) []byte {
+		t.Helper()
+		var all []byte
+		rows, err := db.Query(`SELECT fragment FROM file_fragments ORDER BY file_id, fragment_index`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fragment []byte
+			if err := rows.Scan(&fragment); err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, fragment...)
+		}
+		return all
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		sfs, db := newTestFS(t, sqlitefs.WithEncryption(keys), sqlitefs.WithInlineStorage(1024),
+			sqlitefs.WithCompression(sqlitefs.Flate(5), "application/json"))
+
+		writeFile(t, sfs, "docs/a.txt", text)
+		writeFile(t, sfs, "docs/a.json", text)
+		writeFile(t, sfs, "docs/small.txt", []byte("secret"))
+		writeFile(t, sfs, "docs/empty.txt", nil)
+
+		if stored := fragments(t, db); bytes.Contains(stored, []byte("confidential")) || bytes.Contains(stored, []byte("secret")) {
+			t.Error("Expected no plaintext in stored fragments")
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_metadata WHERE key_id = 'k1' AND data_key IS NOT NULL AND data IS NULL"); n != 4 {
+			t.Errorf("Expected 4 encrypted files stored in fragments, got %d", n)
+		}
+
+		for path, want := range map[string][]byte{"docs/a.txt": text, "docs/a.json": text, "docs/small.txt": []byte("secret"), "docs/empty.txt": {}} {
+			content, err := io.ReadAll(mustOpen(t, sfs, path))
+			if err != nil || !bytes.Equal(content, want) {
+				t.Errorf("Expected the original content of %s back: %v", path, err)
+			}
+			if info, err := fs.Stat(sfs, path); err != nil || info.Size() != int64(len(want)) {
+				t.Errorf("Expected %s to have size %d: %v", path, len(want), err)
+			}
+		}
+
+		file := mustOpen(t, sfs, "docs/a.json")
+		buf := make([]byte, 500)
+		off := int64(2*16*1024 - 100)
+		if _, err := file.(io.ReaderAt).ReadAt(buf, off); err != nil || !bytes.Equal(buf, text[off:off+500]) {
+			t.Errorf("ReadAt across fragments: %v", err)
+		}
+		if end, err := file.(io.Seeker).Seek(0, io.SeekEnd); err != nil || end != int64(len(text)) {
+			t.Errorf("Expected to seek to %d, got %d: %v", len(text), end, err)
+		}
+
+		if report, err := sfs.Check(context.Background()); err != nil || len(report.Problems) != 0 {
+			t.Errorf("Expected a clean check: %v, %v", report.Problems, err)
+		}
+	})
+
+	t.Run("Tampering", func(t *testing.T) {
+		sfs, db := newTestFS(t, sqlitefs.WithEncryption(keys))
+		writeFile(t, sfs, "a.txt", text)
+
+		// Swap two fragments along with their checksums
+		for _, swap := range [][2]int{{0, -1}, {1, 0}, {-1, 1}} {
+			_, err := db.Exec(`UPDATE file_fragments SET fragment_index = ? WHERE fragment_index = ?`, swap[1], swap[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := io.ReadAll(mustOpen(t, sfs, "a.txt"))
+		if !errors.Is(err, sqlitefs.ErrDecrypt) {
+			t.Errorf("Expected ErrDecrypt, got %v", err)
+		}
+		report, err := sfs.Check(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 2 || report.Problems[0].Kind != sqlitefs.ProblemCorrupt {
+			t.Errorf("Expected both swapped fragments to be reported, got %v", report.Problems)
+		}
+	})
+
+	t.Run("MissingKey", func(t *testing.T) {
+		path := dbPath(t)
+		sfs, _ := openTestFS(t, path, sqlitefs.WithEncryption(keys))
+		writeFile(t, sfs, "a.txt", text)
+		sfs.Close()
+
+		sfs, _ = openTestFS(t, path)
+		if _, err := sfs.Open("a.txt"); err == nil {
+			t.Error("Expected opening an encrypted file without a KeyProvider to fail")
+		}
+		sfs.Close()
+
+		sfs, _ = openTestFS(t, path, sqlitefs.WithEncryption(sqlitefs.StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": keys.Keys["k2"]}}))
+		defer sfs.Close()
+		if _, err := sfs.Open("a.txt"); !errors.Is(err, sqlitefs.ErrUnknownKey) {
+			t.Errorf("Expected ErrUnknownKey, got %v", err)
+		}
+
+		other, _ := newTestFS(t, sqlitefs.WithEncryption(sqlitefs.StaticKeys{Current: "none"}))
+		writer := other.NewWriter("b.txt")
+		if _, err := writer.Write(text); !errors.Is(err, sqlitefs.ErrUnknownKey) {
+			t.Errorf("Expected a writer without a master key to fail, got %v", err)
+		}
+		if err := writer.Close(); err == nil {
+			t.Error("Expected Close to fail as well")
+		}
+	})
+
+	t.Run("RotateKeys", func(t *testing.T) {
+		path := dbPath(t)
+		sfs, db := openTestFS(t, path, sqlitefs.WithEncryption(keys))
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			writeFile(t, sfs, name, text)
+		}
+		before := fragments(t, db)
+
+		rotated := keys
+		rotated.Current = "k2"
+		sfs2, _ := openTestFS(t, path, sqlitefs.WithEncryption(rotated))
+		n, err := sfs2.RotateKeys(context.Background())
+		if err != nil || n != 3 {
+			t.Fatalf("Expected 3 files to be re-wrapped, got %d: %v", n, err)
+		}
+		if n, err := sfs2.RotateKeys(context.Background()); err != nil || n != 0 {
+			t.Errorf("Expected nothing left to re-wrap, got %d: %v", n, err)
+		}
+		sfs2.Close()
+		if !bytes.Equal(fragments(t, db), before) {
+			t.Error("Expected fragments to be left untouched")
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_metadata WHERE key_id = 'k2'"); n != 3 {
+			t.Errorf("Expected 3 files wrapped with k2, got %d", n)
+		}
+		sfs.Close()
+
+		// The old master key is no longer needed
+		sfs, _ = openTestFS(t, path, sqlitefs.WithEncryption(sqlitefs.StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": keys.Keys["k2"]}}))
+		defer sfs.Close()
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			if content, err := io.ReadAll(mustOpen(t, sfs, name)); err != nil || !bytes.Equal(content, text) {
+				t.Errorf("Expected the original content of %s back: %v", name, err)
+			}
+		}
+	})
+}
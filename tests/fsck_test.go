@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestCheckRepair tests that Check finds every kind of inconsistency and
+// Repair leaves a consistent store behind
+func TestCheckRepair(t *testing.T) {
+	db := openTestDB(t)
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithInlineStorage(64))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	data := bytes.Repeat([]byte("consistent "), 7000) // 5 fragments
+	for _, path := range []string{"ok.bin", "gap.bin", "short.bin", "corrupt.bin", "hash.bin", "dir/x.txt"} {
+		writer := sfs.NewWriter(path)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	writer := sfs.NewWriter("small.txt")
+	writer.Write([]byte("inline"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	const byPath = "(SELECT id FROM file_metadata WHERE path = ?)"
+	exec("DELETE FROM file_fragments WHERE file_id = "+byPath+" AND fragment_index = 2", "gap.bin")
+	exec("UPDATE file_fragments SET fragment = substr(fragment, 1, 100), crc32c = NULL WHERE file_id = "+byPath+" AND fragment_index = 1", "short.bin")
+	exec("UPDATE file_fragments SET fragment = zeroblob(LENGTH(fragment)) WHERE file_id = "+byPath+" AND fragment_index = 3", "corrupt.bin")
+	exec("UPDATE file_metadata SET sha256 = zeroblob(32) WHERE path IN ('hash.bin', 'small.txt')")
+	exec("INSERT INTO file_metadata (path, type, data) VALUES ('/ok.bin', 'text/plain', x'00'), ('bad//path.txt', 'text/plain', x'00'), ('dir', 'text/plain', x'00')")
+	// Fragments nothing refers to, and an upload that is still in progress
+	exec("INSERT INTO file_fragments (file_id, fragment_index, fragment) VALUES (9001, 0, x'00'), (9001, 1, x'00'), (9002, 0, x'00')")
+	exec("INSERT INTO file_reclaim (file_id, reason, created_at) VALUES (9002, 'upload', ?)", time.Now().Unix())
+
+	type found struct {
+		kind sqlitefs.ProblemKind
+		path string
+	}
+	want := []found{
+		{sqlitefs.ProblemOrphanFragments, ""},
+		{sqlitefs.ProblemGap, "gap.bin"},
+		{sqlitefs.ProblemFragmentSize, "short.bin"},
+		{sqlitefs.ProblemCorrupt, "corrupt.bin"},
+		{sqlitefs.ProblemHashMismatch, "hash.bin"},
+		{sqlitefs.ProblemHashMismatch, "small.txt"},
+		{sqlitefs.ProblemDuplicatePath, "/ok.bin"},
+		{sqlitefs.ProblemMalformedPath, "bad//path.txt"},
+		{sqlitefs.ProblemPathConflict, "dir"},
+	}
+	byKind := func(a, b found) int {
+		if a.kind != b.kind {
+			return int(a.kind - b.kind)
+		}
+		return strings.Compare(a.path, b.path)
+	}
+	slices.SortFunc(want, byKind)
+	problems := func(report sqlitefs.CheckReport) []found {
+		var got []found
+		for _, p := range report.Problems {
+			got = append(got, found{p.Kind, p.Path})
+		}
+		slices.SortFunc(got, byKind)
+		return got
+	}
+
+	report, err := sfs.Check(context.Background())
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if got := problems(report); !slices.Equal(got, want) {
+		t.Errorf("Check found %v, want %v", report.Problems, want)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE file_id = 9001"); n != 2 {
+		t.Errorf("Expected Check to change nothing, %d orphan fragments left", n)
+	}
+	for _, p := range report.Problems {
+		if p.Kind == sqlitefs.ProblemGap && p.Index != 2 {
+			t.Errorf("Expected the gap at fragment 2, got %d", p.Index)
+		}
+		if p.Kind == sqlitefs.ProblemCorrupt && p.Index != 3 {
+			t.Errorf("Expected the corruption at fragment 3, got %d", p.Index)
+		}
+	}
+
+	report, err = sfs.Repair(context.Background())
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if got := problems(report); !slices.Equal(got, want) {
+		t.Errorf("Repair found %v, want %v", report.Problems, want)
+	}
+	for _, p := range report.Problems {
+		if p.Action == "" {
+			t.Errorf("Expected an action for %v", p)
+		}
+	}
+
+	report, err = sfs.Check(context.Background())
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Expected no problems after Repair, got %v", report.Problems)
+	}
+
+	// The truncated file keeps what came before the gap
+	content, err := io.ReadAll(mustOpen(t, sfs, "gap.bin"))
+	if err != nil || !bytes.Equal(content, data[:2*16*1024]) {
+		t.Errorf("Expected gap.bin to be truncated at the gap: %d bytes, %v", len(content), err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE file_id = 9002"); n != 1 {
+		t.Error("Expected the upload in progress to be left alone")
+	}
+	if _, err := fs.Stat(sfs, "ok.bin"); err != nil {
+		t.Errorf("Expected ok.bin to be untouched: %v", err)
+	}
+
+	entries, err := fs.ReadDir(sfs, "lost+found")
+	if err != nil {
+		t.Fatalf("ReadDir(lost+found): %v", err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("Expected 7 files in lost+found, got %d", len(entries))
+	}
+	for _, path := range []string{"short.bin", "corrupt.bin", "hash.bin", "small.txt"} {
+		if _, err := fs.Stat(sfs, path); err == nil {
+			t.Errorf("Expected %s to be moved away", path)
+		}
+	}
+	if info, err := fs.Stat(sfs, "dir"); err != nil || !info.IsDir() {
+		t.Errorf("Expected dir to be a directory again: %v", err)
+	}
+}
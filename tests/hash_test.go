@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestHash tests the SHA-256 digests recorded by writers
+func TestHash(t *testing.T) {
+	db := openTestDB(t)
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithInlineStorage(100))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	files := map[string][]byte{
+		"dir/large.bin":  bytes.Repeat([]byte("0123456789"), 5000),
+		"dir/exact.bin":  bytes.Repeat([]byte{7}, 16*1024*2),
+		"dir/inline.txt": []byte("small"),
+		"empty.txt":      {},
+	}
+	for path, data := range files {
+		writer := sfs.NewWriter(path)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	// Content copied in with ReadFrom
+	writer := sfs.NewWriter("dir/copied.bin")
+	files["dir/copied.bin"] = bytes.Repeat([]byte("copy"), 9000)
+	if _, err := writer.ReadFrom(bytes.NewReader(files["dir/copied.bin"])); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	check := func(t *testing.T, path string, got []byte) {
+		t.Helper()
+		want := sha256.Sum256(files[path])
+		if !bytes.Equal(got, want[:]) {
+			t.Errorf("%s: expected digest %x, got %x", path, want, got)
+		}
+	}
+
+	t.Run("Hash", func(t *testing.T) {
+		for path := range files {
+			sum, err := sfs.Hash(path)
+			if err != nil {
+				t.Fatalf("Hash(%s): %v", path, err)
+			}
+			check(t, path, sum)
+		}
+		if _, err := sfs.Hash("missing.txt"); err == nil {
+			t.Error("Expected an error for a missing file")
+		}
+		if _, err := sfs.Hash("dir"); err == nil {
+			t.Error("Expected an error for a directory")
+		}
+	})
+
+	t.Run("FileInfo", func(t *testing.T) {
+		for path := range files {
+			info, err := fs.Stat(sfs, path)
+			if err != nil {
+				t.Fatalf("Stat(%s): %v", path, err)
+			}
+			check(t, path, info.(sqlitefs.Hasher).SHA256())
+		}
+
+		entries, err := fs.ReadDir(sfs, "dir")
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			check(t, "dir/"+entry.Name(), info.(sqlitefs.Hasher).SHA256())
+		}
+
+		err = sfs.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, _ := d.Info()
+			if d.IsDir() {
+				if sum := info.(sqlitefs.Hasher).SHA256(); sum != nil {
+					t.Errorf("Expected no digest for directory %s, got %x", path, sum)
+				}
+				return nil
+			}
+			check(t, path, info.(sqlitefs.Hasher).SHA256())
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WalkDir: %v", err)
+		}
+
+		for entry, err := range sfs.Walk(".") {
+			if err != nil {
+				t.Fatalf("Walk: %v", err)
+			}
+			if !entry.IsDir() {
+				info, _ := entry.Info()
+				check(t, entry.Path, info.(sqlitefs.Hasher).SHA256())
+			}
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		for _, data := range [][]byte{[]byte("now inline"), bytes.Repeat([]byte("big"), 20000)} {
+			files["dir/inline.txt"] = data
+			writer := sfs.NewWriter("dir/inline.txt")
+			writer.Write(data)
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Failed to overwrite: %v", err)
+			}
+			sum, err := sfs.Hash("dir/inline.txt")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			check(t, "dir/inline.txt", sum)
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		// Rows written before digests were recorded
+		if _, err := db.Exec("UPDATE file_metadata SET sha256 = NULL"); err != nil {
+			t.Fatal(err)
+		}
+		info, err := fs.Stat(sfs, "dir/large.bin")
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if sum := info.(sqlitefs.Hasher).SHA256(); sum != nil {
+			t.Errorf("Expected no digest before hashing, got %x", sum)
+		}
+
+		for path := range files {
+			sum, err := sfs.Hash(path)
+			if err != nil {
+				t.Fatalf("Hash(%s): %v", path, err)
+			}
+			check(t, path, sum)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_metadata WHERE sha256 IS NULL"); n != 0 {
+			t.Errorf("Expected computed digests to be saved, %d rows still without", n)
+		}
+	})
+}
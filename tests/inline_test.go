@@ -0,0 +1,321 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestInlineStorage tests small files kept in their metadata row
+func TestInlineStorage(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:inlinestorage?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithInlineStorage(1024))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	writeFile := func(name string, data []byte) {
+		t.Helper()
+		writer := sfs.NewWriter(name)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+	}
+	fragmentCount := func(name string) int {
+		t.Helper()
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM file_fragments WHERE file_id = (SELECT id FROM file_metadata WHERE path = ?)`, name).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	config := []byte(`{"debug": true, "name": "sqlitefs"}`)
+	writeFile("config/app.json", config)
+
+	t.Run("StoredInline", func(t *testing.T) {
+		if n := fragmentCount("config/app.json"); n != 0 {
+			t.Errorf("Expected no fragments for inline file, got %d", n)
+		}
+
+		got, err := fs.ReadFile(sfs, "config/app.json")
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(got, config) {
+			t.Errorf("Expected %q, got %q", config, got)
+		}
+
+		info, err := fs.Stat(sfs, "config/app.json")
+		if err != nil {
+			t.Fatalf("Failed to stat: %v", err)
+		}
+		if info.Size() != int64(len(config)) {
+			t.Errorf("Expected size %d, got %d", len(config), info.Size())
+		}
+	})
+
+	t.Run("SeekAndReadAt", func(t *testing.T) {
+		file, err := sfs.Open("config/app.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		sqlFile := file.(*sqlitefs.SQLiteFile)
+
+		pos, err := sqlFile.Seek(-11, io.SeekEnd)
+		if err != nil || pos != int64(len(config))-11 {
+			t.Fatalf("Seek returned %d, %v", pos, err)
+		}
+		buf := make([]byte, 11)
+		if _, err := io.ReadFull(sqlFile, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != `"sqlitefs"}` {
+			t.Errorf("Unexpected tail %q", buf)
+		}
+
+		n, err := sqlFile.ReadAt(buf[:5], 2)
+		if err != nil || string(buf[:n]) != `debug` {
+			t.Errorf("ReadAt returned %q, %v", buf[:n], err)
+		}
+	})
+
+	t.Run("ConvertWhenGrowing", func(t *testing.T) {
+		big := bytes.Repeat([]byte("x"), 40000)
+		writeFile("config/app.json", big)
+		if n := fragmentCount("config/app.json"); n != 3 {
+			t.Errorf("Expected 3 fragments after growing, got %d", n)
+		}
+		got, _ := fs.ReadFile(sfs, "config/app.json")
+		if !bytes.Equal(got, big) {
+			t.Error("Content mismatch after growing past the threshold")
+		}
+
+		writeFile("config/app.json", config)
+		if n := fragmentCount("config/app.json"); n != 0 {
+			t.Errorf("Expected inline storage after shrinking, got %d fragments", n)
+		}
+		got, _ = fs.ReadFile(sfs, "config/app.json")
+		if !bytes.Equal(got, config) {
+			t.Error("Content mismatch after shrinking below the threshold")
+		}
+	})
+
+	t.Run("Boundary", func(t *testing.T) {
+		writeFile("edge/exact.bin", bytes.Repeat([]byte("a"), 1024))
+		writeFile("edge/over.bin", bytes.Repeat([]byte("b"), 1025))
+		writeFile("edge/empty.bin", nil)
+
+		if n := fragmentCount("edge/exact.bin"); n != 0 {
+			t.Errorf("Expected file at the threshold to be inline, got %d fragments", n)
+		}
+		if n := fragmentCount("edge/over.bin"); n != 1 {
+			t.Errorf("Expected file over the threshold to use fragments, got %d", n)
+		}
+
+		sizes := map[string]int64{"exact.bin": 1024, "over.bin": 1025, "empty.bin": 0}
+		entries, err := fs.ReadDir(sfs, "edge")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("Expected 3 entries, got %d", len(entries))
+		}
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			if info.Size() != sizes[entry.Name()] {
+				t.Errorf("%s: expected size %d, got %d", entry.Name(), sizes[entry.Name()], info.Size())
+			}
+		}
+
+		got, err := fs.ReadFile(sfs, "edge/empty.bin")
+		if err != nil || len(got) != 0 {
+			t.Errorf("Expected empty content, got %q, %v", got, err)
+		}
+	})
+
+	t.Run("MixedLayouts", func(t *testing.T) {
+		// A database written without inline storage stays readable
+		plain, err := sqlitefs.NewSQLiteFS(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := plain.NewWriter("legacy.txt")
+		writer.Write([]byte("legacy"))
+		writer.Close()
+
+		got, err := fs.ReadFile(sfs, "legacy.txt")
+		if err != nil || string(got) != "legacy" {
+			t.Errorf("Expected legacy content, got %q, %v", got, err)
+		}
+		got, err = fs.ReadFile(plain, "config/app.json")
+		if err != nil || !bytes.Equal(got, config) {
+			t.Errorf("Expected inline content via plain fs, got %q, %v", got, err)
+		}
+	})
+}
+
+// TestInlineStorageMigration tests upgrading a database created without the data column
+func TestInlineStorageMigration(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:inlinemigration?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE file_metadata (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT UNIQUE NOT NULL,
+			type TEXT NOT NULL
+		);
+		CREATE TABLE file_fragments (
+			file_id INTEGER NOT NULL,
+			fragment_index INTEGER NOT NULL,
+			fragment BLOB NOT NULL,
+			PRIMARY KEY (file_id, fragment_index)
+		);
+		INSERT INTO file_metadata (path, type) VALUES ('old.txt', 'text/plain');
+		INSERT INTO file_fragments VALUES (1, 0, 'old content');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithInlineStorage(100))
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer sfs.Close()
+
+	got, err := fs.ReadFile(sfs, "old.txt")
+	if err != nil || string(got) != "old content" {
+		t.Errorf("Expected old content, got %q, %v", got, err)
+	}
+
+	writer := sfs.NewWriter("new.txt")
+	writer.Write([]byte("new"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to write inline file: %v", err)
+	}
+	got, err = fs.ReadFile(sfs, "new.txt")
+	if err != nil || string(got) != "new" {
+		t.Errorf("Expected new content, got %q, %v", got, err)
+	}
+}
+
+// TestNewSQLiteFileMigration tests opening a single file of a database
+// created before any column was added
+func TestNewSQLiteFileMigration(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`
+		CREATE TABLE file_metadata (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT UNIQUE NOT NULL,
+			type TEXT NOT NULL
+		);
+		CREATE TABLE file_fragments (
+			file_id INTEGER NOT NULL,
+			fragment_index INTEGER NOT NULL,
+			fragment BLOB NOT NULL,
+			PRIMARY KEY (file_id, fragment_index)
+		);
+		INSERT INTO file_metadata (path, type) VALUES ('old.txt', 'text/plain');
+		INSERT INTO file_fragments VALUES (1, 0, 'old content');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := sqlitefs.NewSQLiteFile(db, "old.txt")
+	if err != nil {
+		t.Fatalf("Failed to open a file of the old database: %v", err)
+	}
+	defer file.Close()
+
+	got, err := io.ReadAll(file)
+	if err != nil || string(got) != "old content" {
+		t.Errorf("Expected old content, got %q, %v", got, err)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != int64(len(got)) {
+		t.Errorf("Expected size %d, got %v: %v", len(got), info, err)
+	}
+}
+
+// TestNewSQLiteFile tests handles opened on their own, which prepare their
+// statements as they need them
+func TestNewSQLiteFile(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "single.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	open := func() *sql.DB {
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	data := bytes.Repeat([]byte("single file "), 5000)
+	sfs, err := sqlitefs.NewSQLiteFS(open())
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	writer := sfs.NewWriter("dir/a.bin")
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	sfs.Close()
+
+	db := open()
+	defer db.Close()
+	file, err := sqlitefs.NewSQLiteFile(db, "dir/a.bin")
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer file.Close()
+
+	// Concurrent readers share the statements prepared on first use
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1000)
+			off := int64(i * 10000)
+			if _, err := file.ReadAt(buf, off); err != nil || !bytes.Equal(buf, data[off:off+1000]) {
+				t.Errorf("ReadAt(%d): %v", off, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	dir, err := sqlitefs.NewSQLiteFile(db, "dir/")
+	if err != nil {
+		t.Fatalf("Failed to open directory: %v", err)
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "a.bin" {
+		t.Errorf("Expected a.bin in the listing: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestFragmentChecksums tests that corrupted fragments are detected on read
+// and by Scrub
+func TestFragmentChecksums(t *testing.T) {
+	data := bytes.Repeat([]byte("checksummed "), 8000) // 6 fragments
+
+	setup := func(t *testing.T, opts ...sqlitefs.Option) (*sqlitefs.SQLiteFS, func(query string, args ...any)) {
+		db := openTestDB(t)
+		sfs, err := sqlitefs.NewSQLiteFS(db, opts...)
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		t.Cleanup(func() { sfs.Close() })
+		for _, path := range []string{"good.bin", "bad.bin"} {
+			writer := sfs.NewWriter(path)
+			writer.Write(data)
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+		}
+		exec := func(query string, args ...any) {
+			t.Helper()
+			if _, err := db.Exec(query, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sfs, exec
+	}
+	const corrupt = `UPDATE file_fragments SET fragment = zeroblob(LENGTH(fragment))
+		WHERE file_id = (SELECT id FROM file_metadata WHERE path = 'bad.bin') AND fragment_index = ?`
+
+	t.Run("Read", func(t *testing.T) {
+		sfs, exec := setup(t)
+		exec(corrupt, 2)
+
+		content, err := io.ReadAll(mustOpen(t, sfs, "bad.bin"))
+		var corruption *sqlitefs.CorruptionError
+		if !errors.As(err, &corruption) || !errors.Is(err, sqlitefs.ErrCorrupt) {
+			t.Fatalf("Expected a CorruptionError, got %v", err)
+		}
+		if corruption.Path != "bad.bin" || corruption.Index != 2 {
+			t.Errorf("Expected bad.bin fragment 2, got %s fragment %d", corruption.Path, corruption.Index)
+		}
+		if !bytes.Equal(content, data[:2*16*1024]) {
+			t.Errorf("Expected the intact fragments before the damage, got %d bytes", len(content))
+		}
+
+		// Other ranges of the file stay readable
+		file := mustOpen(t, sfs, "bad.bin").(io.ReaderAt)
+		buf := make([]byte, 100)
+		if _, err := file.ReadAt(buf, 3*16*1024); err != nil || !bytes.Equal(buf, data[3*16*1024:3*16*1024+100]) {
+			t.Errorf("Expected fragment 3 to be readable: %v", err)
+		}
+		if _, err := file.ReadAt(buf, 2*16*1024+10); !errors.Is(err, sqlitefs.ErrCorrupt) {
+			t.Errorf("Expected ReadAt to report the damage, got %v", err)
+		}
+
+		if content, err := io.ReadAll(mustOpen(t, sfs, "good.bin")); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected good.bin to be intact: %v", err)
+		}
+	})
+
+	t.Run("ReadAhead", func(t *testing.T) {
+		sfs, exec := setup(t, sqlitefs.WithReadAhead(2))
+		exec(corrupt, 4)
+		if _, err := io.ReadAll(mustOpen(t, sfs, "bad.bin")); !errors.Is(err, sqlitefs.ErrCorrupt) {
+			t.Errorf("Expected a CorruptionError, got %v", err)
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		// Fragments written before checksums were stored
+		sfs, exec := setup(t)
+		exec("UPDATE file_fragments SET crc32c = NULL")
+		if content, err := io.ReadAll(mustOpen(t, sfs, "bad.bin")); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected fragments without checksum to be readable: %v", err)
+		}
+		report, err := sfs.Scrub(context.Background())
+		if err != nil {
+			t.Fatalf("Scrub: %v", err)
+		}
+		if report.Unverified != 12 || len(report.Damaged) != 0 {
+			t.Errorf("Expected 12 unverified fragments, got %+v", report)
+		}
+	})
+
+	t.Run("Scrub", func(t *testing.T) {
+		sfs, exec := setup(t, sqlitefs.WithScrubRate(0))
+		exec(corrupt, 1)
+		exec(corrupt, 5)
+
+		report, err := sfs.Scrub(context.Background())
+		if err != nil {
+			t.Fatalf("Scrub: %v", err)
+		}
+		if report.Fragments != 12 || report.Bytes != int64(2*len(data)) {
+			t.Errorf("Expected 12 fragments and %d bytes, got %+v", 2*len(data), report)
+		}
+		if len(report.Damaged) != 2 {
+			t.Fatalf("Expected 2 damaged fragments, got %d", len(report.Damaged))
+		}
+		for i, index := range []int64{1, 5} {
+			if d := report.Damaged[i]; d.Path != "bad.bin" || d.Index != index {
+				t.Errorf("Expected bad.bin fragment %d, got %s fragment %d", index, d.Path, d.Index)
+			}
+		}
+	})
+
+	t.Run("ScrubRate", func(t *testing.T) {
+		sfs, _ := setup(t, sqlitefs.WithScrubRate(8<<20))
+		large := bytes.Repeat([]byte{1}, 100*16*1024) // more than one page
+		writer := sfs.NewWriter("large.bin")
+		writer.Write(large)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+
+		start := time.Now()
+		report, err := sfs.Scrub(context.Background())
+		if err != nil {
+			t.Fatalf("Scrub: %v", err)
+		}
+		if report.Fragments != 112 {
+			t.Errorf("Expected 112 fragments, got %d", report.Fragments)
+		}
+		// The first page of 64 fragments alone is 1 MiB
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("Expected the scrub to be throttled, took %v", elapsed)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := sfs.Scrub(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the scrub to stop with its context, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"slices"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestIterators tests the streaming Entries and Walk iterators against
+// ReadDir and WalkDir
+func TestIterators(t *testing.T) {
+	sfs, err := sqlitefs.NewSQLiteFS(openTestDB(t), sqlitefs.WithInlineStorage(64))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	files := map[string][]byte{
+		"a.txt":           []byte("root file"),
+		"docs/readme.md":  []byte("readme"),
+		"docs/api/v1.md":  bytes.Repeat([]byte("v1 "), 10000),
+		"docs/api/v2.md":  []byte("v2"),
+		"docs-old/x.txt":  []byte("x"),
+		"docs.txt":        []byte("not a directory"),
+		"img/logo.png":    bytes.Repeat([]byte{0x89}, 20000),
+		"img/deep/a/b/c":  []byte("deep"),
+		"z/last.txt":      []byte("last"),
+		"z/sub/empty.txt": nil,
+	}
+	// More entries than fit in one page
+	for i := 0; i < 600; i++ {
+		files[fmt.Sprintf("big/f%04d", i)] = []byte{byte(i)}
+	}
+	files["big/nested/inner.txt"] = []byte("inner")
+	for path, data := range files {
+		writer := sfs.NewWriter(path)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	t.Run("Entries", func(t *testing.T) {
+		for _, dir := range []string{".", "docs", "docs/api", "big", "img/deep/a"} {
+			want, err := fs.ReadDir(sfs, dir)
+			if err != nil {
+				t.Fatalf("ReadDir(%s): %v", dir, err)
+			}
+			var wantNames []string
+			for _, entry := range want {
+				wantNames = append(wantNames, entry.Name())
+			}
+			slices.Sort(wantNames)
+
+			var got []string
+			for entry, err := range sfs.Entries(dir) {
+				if err != nil {
+					t.Fatalf("Entries(%s): %v", dir, err)
+				}
+				got = append(got, entry.Name())
+			}
+			// Entries come in stored path order, "docs-old" before "docs"
+			slices.Sort(got)
+			if !slices.Equal(got, wantNames) {
+				t.Errorf("Entries(%s): got %d entries %v, want %d", dir, len(got), got[:min(len(got), 10)], len(wantNames))
+			}
+		}
+	})
+
+	t.Run("EntryInfo", func(t *testing.T) {
+		for entry, err := range sfs.Entries("docs/api") {
+			if err != nil {
+				t.Fatalf("Entries: %v", err)
+			}
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatalf("Info(%s): %v", entry.Name(), err)
+			}
+			if want := int64(len(files["docs/api/"+entry.Name()])); info.Size() != want {
+				t.Errorf("%s: expected size %d, got %d", entry.Name(), want, info.Size())
+			}
+		}
+		for entry, err := range sfs.Entries("img") {
+			if err != nil {
+				t.Fatalf("Entries: %v", err)
+			}
+			if want := entry.Name() == "deep"; entry.IsDir() != want || entry.Type().IsDir() != want {
+				t.Errorf("%s: expected IsDir %v", entry.Name(), want)
+			}
+		}
+	})
+
+	t.Run("Break", func(t *testing.T) {
+		n := 0
+		for _, err := range sfs.Entries("big") {
+			if err != nil {
+				t.Fatalf("Entries: %v", err)
+			}
+			n++
+			if n == 10 {
+				break
+			}
+		}
+		if n != 10 {
+			t.Errorf("Expected to stop after 10 entries, got %d", n)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		for _, err := range sfs.Entries("nope") {
+			if err == nil {
+				t.Error("Expected an error for a missing directory")
+			}
+		}
+		for _, err := range sfs.Walk("nope") {
+			if err == nil {
+				t.Error("Expected an error for a missing directory")
+			}
+		}
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		for _, root := range []string{".", "docs", "img"} {
+			var want []string
+			err := fs.WalkDir(sfs, root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if path != root {
+					want = append(want, path)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("WalkDir(%s): %v", root, err)
+			}
+			slices.Sort(want)
+
+			var got []string
+			for entry, err := range sfs.Walk(root) {
+				if err != nil {
+					t.Fatalf("Walk(%s): %v", root, err)
+				}
+				if entry.IsDir() {
+					// Directories come before their contents
+					if slices.ContainsFunc(got, func(p string) bool { return len(p) > len(entry.Path) && p[:len(entry.Path)+1] == entry.Path+"/" }) {
+						t.Errorf("Walk(%s): directory %s after its contents", root, entry.Path)
+					}
+				} else if info, err := entry.Info(); err != nil || info.Size() != int64(len(files[entry.Path])) {
+					t.Errorf("Walk(%s): %s has size %v, %v", root, entry.Path, info, err)
+				}
+				got = append(got, entry.Path)
+			}
+			sorted := slices.Clone(got)
+			slices.Sort(sorted)
+			if !slices.Equal(sorted, want) {
+				t.Errorf("Walk(%s): got %d paths, want %d", root, len(got), len(want))
+			}
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jilio/sqlitefs"
@@ -19,6 +20,73 @@ func setupTestDB(t *testing.T) *sql.DB {
 	return db
 }
 
+// mustOpen opens name and closes it when the test ends
+func mustOpen(t *testing.T, fs *sqlitefs.SQLiteFS, name string) io.ReadCloser {
+	t.Helper()
+	file, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+// openTestDB opens a database file in a temporary directory. Tests that
+// read from several goroutines use it instead of a shared-cache in-memory
+// database, which SQLite discards as soon as the pool closes its last
+// connection and which serializes readers and writers with table locks.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	return openTestDBAt(t, filepath.Join(t.TempDir(), "test.db"))
+}
+
+// openTestDBAt opens the database file at path, so tests can open it again
+// after a SQLiteFS on it was closed.
+func openTestDBAt(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestFS creates a SQLiteFS on a new database file and closes it when
+// the test ends.
+func newTestFS(t *testing.T, opts ...sqlitefs.Option) (*sqlitefs.SQLiteFS, *sql.DB) {
+	t.Helper()
+	sfs, db := openTestFS(t, filepath.Join(t.TempDir(), "test.db"), opts...)
+	t.Cleanup(func() { sfs.Close() })
+	return sfs, db
+}
+
+// openTestFS creates a SQLiteFS on the database file at path; closing it is
+// up to the caller.
+func openTestFS(t *testing.T, path string, opts ...sqlitefs.Option) (*sqlitefs.SQLiteFS, *sql.DB) {
+	t.Helper()
+	db := openTestDBAt(t, path)
+	sfs, err := sqlitefs.NewSQLiteFS(db, opts...)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	return sfs, db
+}
+
+// writeFile stores data at path in a single Write and fails the test if
+// the write or the commit fails.
+func writeFile(t *testing.T, sfs *sqlitefs.SQLiteFS, path string, data []byte, opts ...sqlitefs.WriterOption) {
+	t.Helper()
+	writer := sfs.NewWriter(path, opts...)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close %s: %v", path, err)
+	}
+}
+
 // TestBasicFileOperations tests core file creation, reading, and writing
 func TestBasicFileOperations(t *testing.T) {
 	db := setupTestDB(t)
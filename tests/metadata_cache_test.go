@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"database/sql"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestMetadataCache tests that cached metadata follows writes and removals
+func TestMetadataCache(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:metadatacache?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithMetadataCache(100))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	writeFile := func(name string, size int) {
+		t.Helper()
+		writer := sfs.NewWriter(name)
+		writer.Write(make([]byte, size))
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+	}
+	listNames := func(dir string) []string {
+		t.Helper()
+		entries, err := fs.ReadDir(sfs, dir)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", dir, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	writeFile("assets/app.js", 100)
+
+	t.Run("StatFollowsOverwrite", func(t *testing.T) {
+		info, err := fs.Stat(sfs, "assets/app.js")
+		if err != nil {
+			t.Fatalf("Failed to stat: %v", err)
+		}
+		if info.Size() != 100 {
+			t.Errorf("Expected size 100, got %d", info.Size())
+		}
+
+		writeFile("assets/app.js", 40000)
+
+		info, err = fs.Stat(sfs, "assets/app.js")
+		if err != nil {
+			t.Fatalf("Failed to stat: %v", err)
+		}
+		if info.Size() != 40000 {
+			t.Errorf("Expected size 40000 after overwrite, got %d", info.Size())
+		}
+	})
+
+	t.Run("ListingFollowsWrites", func(t *testing.T) {
+		if names := listNames("assets"); len(names) != 1 || names[0] != "app.js" {
+			t.Fatalf("Unexpected listing: %v", names)
+		}
+		if names := listNames("."); len(names) != 1 || names[0] != "assets" {
+			t.Fatalf("Unexpected root listing: %v", names)
+		}
+
+		writeFile("assets/css/site.css", 10)
+
+		if names := listNames("assets"); len(names) != 2 || names[0] != "app.js" || names[1] != "css" {
+			t.Errorf("Listing not invalidated after write: %v", names)
+		}
+
+		entries, err := fs.ReadDir(sfs, "assets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			if entry.Name() == "app.js" && info.Size() != 40000 {
+				t.Errorf("Expected listed size 40000, got %d", info.Size())
+			}
+		}
+	})
+
+	t.Run("NegativeLookupFollowsCreate", func(t *testing.T) {
+		if _, err := sfs.Open("late.txt"); err == nil {
+			t.Fatal("Expected error opening missing file")
+		}
+		if _, err := sfs.Open("later"); err == nil {
+			t.Fatal("Expected error opening missing directory")
+		}
+
+		writeFile("late.txt", 5)
+		writeFile("later/file.txt", 5)
+
+		if _, err := sfs.Open("late.txt"); err != nil {
+			t.Errorf("Cached non-existence not invalidated: %v", err)
+		}
+		if _, err := sfs.Open("later"); err != nil {
+			t.Errorf("Cached missing directory not invalidated: %v", err)
+		}
+	})
+
+	t.Run("RemoveInvalidates", func(t *testing.T) {
+		if err := sfs.Remove("assets/css/site.css"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if _, err := fs.Stat(sfs, "assets/css/site.css"); err == nil {
+			t.Error("Expected removed file to be gone")
+		}
+		if _, err := sfs.Open("assets/css"); err == nil {
+			t.Error("Expected empty directory to be gone")
+		}
+		if names := listNames("assets"); len(names) != 1 || names[0] != "app.js" {
+			t.Errorf("Listing not invalidated after remove: %v", names)
+		}
+	})
+}
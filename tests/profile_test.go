@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestProfiles tests OpenSQLiteFS with separate read and write pools
+func TestProfiles(t *testing.T) {
+	t.Run("Lookup", func(t *testing.T) {
+		for _, name := range []string{"server", "embedded", "bulk-load"} {
+			p, ok := sqlitefs.LookupProfile(name)
+			if !ok || p.Name != name {
+				t.Errorf("LookupProfile(%q) = %v, %v", name, p.Name, ok)
+			}
+		}
+		if _, ok := sqlitefs.LookupProfile("unknown"); ok {
+			t.Error("Expected unknown profile to be missing")
+		}
+	})
+
+	for _, profile := range []sqlitefs.Profile{sqlitefs.ProfileServer, sqlitefs.ProfileEmbedded, sqlitefs.ProfileBulkLoad} {
+		t.Run(profile.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fs.db")
+			sfs, err := sqlitefs.OpenSQLiteFS("sqlite", path, profile)
+			if err != nil {
+				t.Fatalf("Failed to open SQLiteFS: %v", err)
+			}
+
+			data := bytes.Repeat([]byte("profile "), 5000)
+			writer := sfs.NewWriter("dir/file.bin")
+			writer.Write(data)
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Failed to close writer: %v", err)
+			}
+
+			content, err := io.ReadAll(mustOpen(t, sfs, "dir/file.bin"))
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			if !bytes.Equal(content, data) {
+				t.Error("Content mismatch")
+			}
+
+			entries, err := fs.ReadDir(sfs, "dir")
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("ReadDir = %v, %v", entries, err)
+			}
+
+			if err := sfs.Close(); err != nil {
+				t.Fatalf("Failed to close SQLiteFS: %v", err)
+			}
+
+			// The WAL is truncated by the checkpoint on close
+			if info, err := os.Stat(path + "-wal"); err == nil && info.Size() != 0 {
+				t.Errorf("Expected empty WAL after close, got %d bytes", info.Size())
+			}
+
+			db, err := sql.Open("sqlite", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var mode string
+			if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.EqualFold(mode, profile.JournalMode) {
+				t.Errorf("Expected journal mode %s, got %s", profile.JournalMode, mode)
+			}
+		})
+	}
+
+	t.Run("ReadsDuringWrites", func(t *testing.T) {
+		sfs, err := sqlitefs.OpenSQLiteFS("sqlite", filepath.Join(t.TempDir(), "fs.db"), sqlitefs.ProfileServer)
+		if err != nil {
+			t.Fatalf("Failed to open SQLiteFS: %v", err)
+		}
+		defer sfs.Close()
+
+		data := bytes.Repeat([]byte{7}, 16*1024*8)
+		writer := sfs.NewWriter("stable.bin")
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		// A reader holding a handle mid-file must not stall the writer
+		reader := mustOpen(t, sfs, "stable.bin")
+		if _, err := io.ReadFull(reader, make([]byte, 1000)); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := sfs.NewWriter("out/" + string(rune('a'+i)) + ".bin")
+				w.Write(data)
+				errs <- w.Close()
+			}(i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f, err := sfs.Open("stable.bin")
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer f.Close()
+				content, err := io.ReadAll(f)
+				if err == nil && !bytes.Equal(content, data) {
+					err = io.ErrUnexpectedEOF
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Concurrent operation failed: %v", err)
+			}
+		}
+
+		rest, err := io.ReadAll(reader)
+		if err != nil || len(rest) != len(data)-1000 {
+			t.Errorf("Failed to finish read: %d bytes, %v", len(rest), err)
+		}
+	})
+
+	t.Run("WithReadDB", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "fs.db")
+		writeDB, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeDB.SetMaxOpenConns(1)
+		readDB, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sfs, err := sqlitefs.NewSQLiteFS(writeDB, sqlitefs.WithReadDB(readDB))
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+
+		writer := sfs.NewWriter("a.txt")
+		writer.Write([]byte("through the write pool"))
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		if err := sfs.Remove("a.txt"); err != nil {
+			t.Fatalf("Failed to remove through the write pool: %v", err)
+		}
+
+		writer = sfs.NewWriter("b.txt")
+		writer.Write([]byte("read back"))
+		writer.Close()
+		content, err := io.ReadAll(mustOpen(t, sfs, "b.txt"))
+		if err != nil || string(content) != "read back" {
+			t.Errorf("Read %q, %v", content, err)
+		}
+
+		if err := sfs.Close(); err != nil {
+			t.Fatalf("Failed to close SQLiteFS: %v", err)
+		}
+		if err := readDB.Ping(); err == nil {
+			t.Error("Expected the read pool to be closed with the filesystem")
+		}
+	})
+}
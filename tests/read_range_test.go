@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestMultiFragmentReads tests reads whose buffers span several fragments
+func TestMultiFragmentReads(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:multifragment?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db)
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 16*1024*7+500)
+	for i := range data {
+		data[i] = byte(i*7 + i/16384)
+	}
+	writer := fs.NewWriter("multi.bin")
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	for _, bufSize := range []int{333, 1000, 16 * 1024, 16*1024 + 1, 50000, len(data) + 10} {
+		file, err := fs.Open("multi.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+
+		var got []byte
+		buf := make([]byte, bufSize)
+		for {
+			n, err := file.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read with buffer %d failed: %v", bufSize, err)
+			}
+		}
+		file.Close()
+
+		if !bytes.Equal(got, data) {
+			t.Errorf("Buffer %d: content mismatch, got %d bytes", bufSize, len(got))
+		}
+	}
+
+	t.Run("SeekAcrossFragments", func(t *testing.T) {
+		file, err := fs.Open("multi.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+
+		sqlFile := file.(*sqlitefs.SQLiteFile)
+		offset := int64(16*1024 - 10)
+		if _, err := sqlFile.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16*1024*3)
+		n, err := sqlFile.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if n != len(buf) {
+			t.Errorf("Expected %d bytes, got %d", len(buf), n)
+		}
+		if !bytes.Equal(buf[:n], data[offset:offset+int64(n)]) {
+			t.Error("Content mismatch after seek")
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestReadAhead tests sequential reads served by background prefetching
+func TestReadAhead(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithReadAhead(4))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 16*1024*13+77)
+	for i := range data {
+		data[i] = byte(i * 31 / 7)
+	}
+	writer := fs.NewWriter("video.bin")
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	t.Run("SequentialRead", func(t *testing.T) {
+		for _, bufSize := range []int{4096, 10000, 16 * 1024, 40000} {
+			file, err := fs.Open("video.bin")
+			if err != nil {
+				t.Fatalf("Failed to open file: %v", err)
+			}
+			var got []byte
+			buf := make([]byte, bufSize)
+			for {
+				n, err := file.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read with buffer %d failed: %v", bufSize, err)
+				}
+			}
+			file.Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("Buffer %d: content mismatch, got %d bytes", bufSize, len(got))
+			}
+		}
+	})
+
+	t.Run("SeekCancelsPrefetch", func(t *testing.T) {
+		file, err := fs.Open("video.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+		sqlFile := file.(*sqlitefs.SQLiteFile)
+
+		buf := make([]byte, 5000)
+		for i := 0; i < 3; i++ {
+			if _, err := sqlFile.Read(buf); err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+		}
+
+		for _, offset := range []int64{100000, 3, 16*1024*12 + 5} {
+			if _, err := sqlFile.Seek(offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				n, err := sqlFile.Read(buf)
+				if err != nil && err != io.EOF {
+					t.Fatalf("Failed to read after seek: %v", err)
+				}
+				pos := offset + int64(i*len(buf))
+				if !bytes.Equal(buf[:n], data[min(pos, int64(len(data))):min(pos+int64(n), int64(len(data)))]) {
+					t.Errorf("Content mismatch at offset %d", pos)
+				}
+				if n < len(buf) {
+					break
+				}
+			}
+		}
+	})
+
+	t.Run("LoadsAhead", func(t *testing.T) {
+		// The fragment cache shows which fragments were loaded
+		cached, _ := newTestFS(t, sqlitefs.WithReadAhead(4), sqlitefs.WithFragmentCache(1<<20))
+		writeFile(t, cached, "video.bin", data)
+
+		file := mustOpen(t, cached, "video.bin")
+		defer file.Close()
+		buf := make([]byte, 5000)
+		for i := 0; i < 2; i++ {
+			if _, err := io.ReadFull(file, buf); err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+		}
+
+		// Reading within fragment 0 prefetches the ones after it
+		entries := cached.CacheStats().Entries
+		for deadline := time.Now().Add(5 * time.Second); entries < 5 && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			entries = cached.CacheStats().Entries
+		}
+		if entries < 5 {
+			t.Errorf("Expected fragments ahead of the read position to be loaded, %d are", entries)
+		}
+
+		// Seeking away stops the prefetcher, which is blocked on a full
+		// window by now
+		goroutines := runtime.NumGoroutine()
+		if _, err := file.(io.Seeker).Seek(100000, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		running := runtime.NumGoroutine()
+		for deadline := time.Now().Add(5 * time.Second); running >= goroutines && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			running = runtime.NumGoroutine()
+		}
+		if running >= goroutines {
+			t.Error("Expected Seek to stop the prefetcher")
+		}
+	})
+
+	t.Run("CloseMidStream", func(t *testing.T) {
+		file, err := fs.Open("video.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		buf := make([]byte, 1024)
+		file.Read(buf)
+		file.Read(buf)
+		if err := file.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestReadAt tests random access reads through io.ReaderAt
+func TestReadAt(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db)
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	data := make([]byte, 16*1024*5+321)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	writer := fs.NewWriter("random.bin")
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	file, err := fs.Open("random.bin")
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+	sqlFile := file.(*sqlitefs.SQLiteFile)
+
+	t.Run("Ranges", func(t *testing.T) {
+		cases := []struct {
+			off, length int64
+		}{
+			{0, 10},
+			{16*1024 - 5, 10},
+			{100, 16 * 1024 * 3},
+			{int64(len(data)) - 7, 7},
+		}
+		for _, tc := range cases {
+			buf := make([]byte, tc.length)
+			n, err := sqlFile.ReadAt(buf, tc.off)
+			if err != nil {
+				t.Fatalf("ReadAt(%d, %d) failed: %v", tc.off, tc.length, err)
+			}
+			if !bytes.Equal(buf[:n], data[tc.off:tc.off+tc.length]) {
+				t.Errorf("ReadAt(%d, %d) returned wrong content", tc.off, tc.length)
+			}
+		}
+	})
+
+	t.Run("PastEnd", func(t *testing.T) {
+		buf := make([]byte, 20)
+		n, err := sqlFile.ReadAt(buf, int64(len(data))-10)
+		if n != 10 || err != io.EOF {
+			t.Errorf("Expected 10 bytes and EOF, got %d and %v", n, err)
+		}
+		n, err = sqlFile.ReadAt(buf, int64(len(data))+5)
+		if n != 0 || err != io.EOF {
+			t.Errorf("Expected 0 bytes and EOF, got %d and %v", n, err)
+		}
+		if _, err := sqlFile.ReadAt(buf, -1); err == nil {
+			t.Error("Expected error for negative offset")
+		}
+	})
+
+	t.Run("OffsetUntouched", func(t *testing.T) {
+		sqlFile.Seek(42, io.SeekStart)
+		sqlFile.ReadAt(make([]byte, 1000), 5000)
+		buf := make([]byte, 8)
+		sqlFile.Read(buf)
+		if !bytes.Equal(buf, data[42:50]) {
+			t.Error("ReadAt moved the read offset")
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				off := int64(g * 5000)
+				buf := make([]byte, 7000)
+				n, err := sqlFile.ReadAt(buf, off)
+				if err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+					errs <- fmt.Errorf("goroutine %d read wrong content", g)
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ZipReader", func(t *testing.T) {
+		var archive bytes.Buffer
+		zw := zip.NewWriter(&archive)
+		for i := 0; i < 3; i++ {
+			w, err := zw.Create(fmt.Sprintf("entry%d.txt", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(bytes.Repeat([]byte{byte('a' + i)}, 20000))
+		}
+		zw.Close()
+
+		writer := fs.NewWriter("archive.zip")
+		writer.Write(archive.Bytes())
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		zipFile, err := fs.Open("archive.zip")
+		if err != nil {
+			t.Fatalf("Failed to open archive: %v", err)
+		}
+		defer zipFile.Close()
+
+		zr, err := zip.NewReader(zipFile.(io.ReaderAt), int64(archive.Len()))
+		if err != nil {
+			t.Fatalf("Failed to read zip: %v", err)
+		}
+		for i, entry := range zr.File {
+			rc, err := entry.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", entry.Name, err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", entry.Name, err)
+			}
+			if !bytes.Equal(content, bytes.Repeat([]byte{byte('a' + i)}, 20000)) {
+				t.Errorf("Entry %s has wrong content", entry.Name)
+			}
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// openShared opens another SQLiteFS on the database file at path, the way a
+// second process would. No busy timeout is configured so lock conflicts
+// reach the retry policy.
+func openShared(t *testing.T, path string, opts ...sqlitefs.Option) *sqlitefs.SQLiteFS {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfs, err := sqlitefs.NewSQLiteFS(db, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	t.Cleanup(func() { sfs.Close() })
+	return sfs
+}
+
+// holdWriteLock takes the database write lock from a separate connection
+// and returns a function releasing it.
+func holdWriteLock(t *testing.T, path string) func() {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to take write lock: %v", err)
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		db.Close()
+	}
+}
+
+// TestBusyRetry tests retrying of statements that find the database locked
+func TestBusyRetry(t *testing.T) {
+	t.Run("TwoInstancesOneFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "shared.db")
+		instances := []*sqlitefs.SQLiteFS{openShared(t, path), openShared(t, path)}
+
+		data := bytes.Repeat([]byte("shared "), 5000)
+		var wg sync.WaitGroup
+		errs := make(chan error, 40)
+		for i, sfs := range instances {
+			for j := 0; j < 10; j++ {
+				wg.Add(1)
+				go func(sfs *sqlitefs.SQLiteFS, name string) {
+					defer wg.Done()
+					writer := sfs.NewWriter(name)
+					writer.Write(data)
+					errs <- writer.Close()
+				}(sfs, fmt.Sprintf("p%d/file%d.bin", i, j))
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Write failed: %v", err)
+			}
+		}
+
+		// Each instance sees what the other one wrote
+		for i, sfs := range instances {
+			other := 1 - i
+			for j := 0; j < 10; j++ {
+				content, err := io.ReadAll(mustOpen(t, sfs, fmt.Sprintf("p%d/file%d.bin", other, j)))
+				if err != nil || !bytes.Equal(content, data) {
+					t.Errorf("Instance %d reading p%d/file%d.bin: %d bytes, %v", i, other, j, len(content), err)
+				}
+			}
+		}
+
+		// Removing through one instance is visible to the other
+		if err := instances[0].Remove("p1/file0.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if _, err := instances[1].Open("p1/file0.bin"); err == nil {
+			t.Error("Expected removed file to be gone for the other instance")
+		}
+	})
+
+	t.Run("WaitsForLock", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "locked.db")
+		sfs := openShared(t, path)
+
+		release := holdWriteLock(t, path)
+		time.AfterFunc(100*time.Millisecond, release)
+
+		writer := sfs.NewWriter("late.txt")
+		writer.Write([]byte("written once the lock is gone"))
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Expected write to succeed after retrying: %v", err)
+		}
+
+		stats := sfs.RetryStats()
+		if stats.Retries == 0 || stats.Recovered == 0 {
+			t.Errorf("Expected retries to be counted, got %+v", stats)
+		}
+		if stats.Waited <= 0 {
+			t.Errorf("Expected backoff time to be counted, got %+v", stats)
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "exhausted.db")
+		sfs := openShared(t, path, sqlitefs.WithRetryPolicy(sqlitefs.RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			Multiplier:     2,
+		}))
+
+		release := holdWriteLock(t, path)
+		defer release()
+
+		writer := sfs.NewWriter("never.txt")
+		writer.Write([]byte("blocked"))
+		err := writer.Close()
+		if !errors.Is(err, sqlitefs.ErrBusy) {
+			t.Fatalf("Expected ErrBusy, got %v", err)
+		}
+
+		stats := sfs.RetryStats()
+		if stats.Retries != 2 || stats.Exhausted != 1 {
+			t.Errorf("Expected 2 retries and 1 exhausted operation, got %+v", stats)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "disabled.db")
+		sfs := openShared(t, path, sqlitefs.WithRetryPolicy(sqlitefs.RetryPolicy{}))
+
+		release := holdWriteLock(t, path)
+		defer release()
+
+		writer := sfs.NewWriter("never.txt")
+		writer.Write([]byte("blocked"))
+		err := writer.Close()
+		if err == nil || errors.Is(err, sqlitefs.ErrBusy) {
+			t.Fatalf("Expected the raw driver error, got %v", err)
+		}
+		if stats := sfs.RetryStats(); stats.Retries != 0 {
+			t.Errorf("Expected no retries, got %+v", stats)
+		}
+	})
+}
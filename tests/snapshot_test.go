@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestSnapshotReads tests that handles keep reading the version they opened
+func TestSnapshotReads(t *testing.T) {
+	configs := []struct {
+		name string
+		opts []sqlitefs.Option
+	}{
+		{"Default", nil},
+		{"Cached", []sqlitefs.Option{sqlitefs.WithFragmentCache(1 << 20), sqlitefs.WithMetadataCache(100)}},
+		{"ReadAhead", []sqlitefs.Option{sqlitefs.WithReadAhead(2)}},
+	}
+
+	oldData := bytes.Repeat([]byte("old version "), 6000)
+	newData := bytes.Repeat([]byte("NEW"), 7000)
+
+	for _, cfg := range configs {
+		t.Run(cfg.name, func(t *testing.T) {
+			sfs, _ := newTestFS(t, cfg.opts...)
+
+			t.Run("OverwriteWhileReading", func(t *testing.T) {
+				writeFile(t, sfs, "doc.txt", oldData)
+
+				reader := mustOpen(t, sfs, "doc.txt")
+				head := make([]byte, 20000)
+				if _, err := io.ReadFull(reader, head); err != nil {
+					t.Fatalf("Failed to read: %v", err)
+				}
+
+				writeFile(t, sfs, "doc.txt", newData)
+
+				rest, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("Failed to finish read: %v", err)
+				}
+				if got := append(head, rest...); !bytes.Equal(got, oldData) {
+					t.Errorf("Expected the old version only, got %d bytes", len(got))
+				}
+
+				content, err := io.ReadAll(mustOpen(t, sfs, "doc.txt"))
+				if err != nil || !bytes.Equal(content, newData) {
+					t.Errorf("Expected new handles to see the new version: %d bytes, %v", len(content), err)
+				}
+			})
+
+			t.Run("ReadAtAndSeek", func(t *testing.T) {
+				writeFile(t, sfs, "seek.bin", oldData)
+
+				file, err := sfs.Open("seek.bin")
+				if err != nil {
+					t.Fatalf("Failed to open: %v", err)
+				}
+				defer file.Close()
+
+				writeFile(t, sfs, "seek.bin", newData)
+
+				info, err := file.Stat()
+				if err != nil || info.Size() != int64(len(oldData)) {
+					t.Fatalf("Expected Stat to report the open version's size %d: %v, %v", len(oldData), info, err)
+				}
+				sum := sha256.Sum256(oldData)
+				if h, ok := info.(sqlitefs.Hasher); !ok || !bytes.Equal(h.SHA256(), sum[:]) {
+					t.Error("Expected Stat to report the open version's digest")
+				}
+
+				sqlFile := file.(*sqlitefs.SQLiteFile)
+				buf := make([]byte, 100)
+				if _, err := sqlFile.ReadAt(buf, int64(len(oldData)-100)); err != nil {
+					t.Fatalf("ReadAt failed: %v", err)
+				}
+				if !bytes.Equal(buf, oldData[len(oldData)-100:]) {
+					t.Error("ReadAt returned data of another version")
+				}
+
+				if _, err := sqlFile.Seek(-50, io.SeekEnd); err != nil {
+					t.Fatalf("Seek failed: %v", err)
+				}
+				tail, err := io.ReadAll(sqlFile)
+				if err != nil || !bytes.Equal(tail, oldData[len(oldData)-50:]) {
+					t.Errorf("Expected the old tail, got %q, %v", tail, err)
+				}
+			})
+
+			t.Run("SeekEndAfterRemove", func(t *testing.T) {
+				writeFile(t, sfs, "removed.bin", oldData)
+
+				file := mustOpen(t, sfs, "removed.bin")
+				defer file.Close()
+				if err := sfs.Remove("removed.bin"); err != nil {
+					t.Fatalf("Failed to remove: %v", err)
+				}
+				end, err := file.(io.Seeker).Seek(0, io.SeekEnd)
+				if err != nil || end != int64(len(oldData)) {
+					t.Errorf("Expected Seek to the end of the open version at %d, got %d, %v", len(oldData), end, err)
+				}
+			})
+
+			t.Run("UncommittedWriteInvisible", func(t *testing.T) {
+				writeFile(t, sfs, "partial.txt", oldData)
+
+				writer := sfs.NewWriter("partial.txt")
+				if _, err := writer.Write(newData[:len(newData)/2]); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+
+				content, err := io.ReadAll(mustOpen(t, sfs, "partial.txt"))
+				if err != nil || !bytes.Equal(content, oldData) {
+					t.Errorf("Expected the committed version during a write: %d bytes, %v", len(content), err)
+				}
+
+				writer2 := sfs.NewWriter("fresh.txt")
+				if _, err := writer2.Write(newData); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+				if _, err := sfs.Open("fresh.txt"); err == nil {
+					t.Error("Expected a file being written for the first time to be missing")
+				}
+
+				if _, err := writer.Write(newData[len(newData)/2:]); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Failed to close writer: %v", err)
+				}
+				if err := writer2.Close(); err != nil {
+					t.Fatalf("Failed to close writer: %v", err)
+				}
+
+				for _, path := range []string{"partial.txt", "fresh.txt"} {
+					content, err := io.ReadAll(mustOpen(t, sfs, path))
+					if err != nil || !bytes.Equal(content, newData) {
+						t.Errorf("Expected %s to be complete after Close: %d bytes, %v", path, len(content), err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestSnapshotForeignKeys tests that writes commit on a connection with
+// foreign_keys enabled, also on a database created with the foreign key on
+// file_fragments that older versions declared
+func TestSnapshotForeignKeys(t *testing.T) {
+	oldData := bytes.Repeat([]byte("old version "), 6000)
+	newData := bytes.Repeat([]byte("NEW"), 7000)
+
+	open := func(t *testing.T, schema string) *sqlitefs.SQLiteFS {
+		db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "fk.db")+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+		sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithPOSIXUnlink())
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		t.Cleanup(func() { sfs.Close() })
+		return sfs
+	}
+
+	for _, tc := range []struct{ name, schema string }{
+		{"NewDatabase", ""},
+		{"Upgraded", `
+			CREATE TABLE file_metadata (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				path TEXT UNIQUE NOT NULL,
+				type TEXT NOT NULL
+			);
+			CREATE TABLE file_fragments (
+				file_id INTEGER NOT NULL,
+				fragment_index INTEGER NOT NULL,
+				fragment BLOB NOT NULL,
+				PRIMARY KEY (file_id, fragment_index),
+				FOREIGN KEY (file_id) REFERENCES file_metadata(id)
+			);
+			INSERT INTO file_metadata (path, type) VALUES ('old.txt', 'text/plain');
+			INSERT INTO file_fragments VALUES (1, 0, 'old content');
+		`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sfs := open(t, tc.schema)
+			writeFile(t, sfs, "doc.txt", oldData)
+
+			reader := mustOpen(t, sfs, "doc.txt")
+			writeFile(t, sfs, "doc.txt", newData)
+			if err := sfs.Remove("doc.txt"); err != nil {
+				t.Fatalf("Failed to remove: %v", err)
+			}
+			content, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(content, oldData) {
+				t.Errorf("Expected the pinned version: %d bytes, %v", len(content), err)
+			}
+			if err := reader.Close(); err != nil {
+				t.Errorf("Failed to close: %v", err)
+			}
+
+			if tc.schema != "" {
+				content, err := fs.ReadFile(sfs, "old.txt")
+				if err != nil || string(content) != "old content" {
+					t.Errorf("Expected the upgraded table to keep its fragments: %q, %v", content, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+func countRows(t *testing.T, db *sql.DB, query string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// TestPOSIXUnlink tests that removed and replaced content stays readable
+// through open handles until the last one is closed
+func TestPOSIXUnlink(t *testing.T) {
+	data := bytes.Repeat([]byte("unlinked "), 8000) // 5 fragments
+	newData := []byte("replacement")                // 1 fragment
+
+	t.Run("RemoveWhileOpen", func(t *testing.T) {
+		sfs, db := newTestFS(t, sqlitefs.WithPOSIXUnlink())
+		writeFile(t, sfs, "gone.bin", data)
+
+		file, err := sfs.Open("gone.bin")
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		head := make([]byte, 1000)
+		if _, err := io.ReadFull(file, head); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+
+		if err := sfs.Remove("gone.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if _, err := sfs.Open("gone.bin"); err == nil {
+			t.Error("Expected removed path to be gone")
+		}
+
+		rest, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(append(head, rest...), data) {
+			t.Errorf("Expected the removed content through the open handle: %d bytes, %v", len(rest), err)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 5 {
+			t.Errorf("Expected fragments to stay while open, got %d", n)
+		}
+
+		if err := file.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 0 {
+			t.Errorf("Expected fragments to be reclaimed after the last close, got %d", n)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_reclaim"); n != 0 {
+			t.Errorf("Expected an empty reclaim journal, got %d", n)
+		}
+	})
+
+	t.Run("StatAfterRemove", func(t *testing.T) {
+		sfs, _ := newTestFS(t, sqlitefs.WithPOSIXUnlink())
+		writeFile(t, sfs, "gone.bin", data)
+
+		file, err := sfs.Open("gone.bin")
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		defer file.Close()
+		if err := sfs.Remove("gone.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		info, err := file.Stat()
+		if err != nil || info.Size() != int64(len(data)) || info.Name() != "gone.bin" {
+			t.Errorf("Expected Stat to describe the removed file: %v, %v", info, err)
+		}
+	})
+
+	t.Run("LastHandleReclaims", func(t *testing.T) {
+		sfs, db := newTestFS(t, sqlitefs.WithPOSIXUnlink())
+		writeFile(t, sfs, "shared.bin", data)
+
+		first := mustOpen(t, sfs, "shared.bin")
+		second, err := sfs.Open("shared.bin")
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		if err := sfs.Remove("shared.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+
+		second.Close()
+		content, err := io.ReadAll(first)
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the remaining handle to read everything: %d bytes, %v", len(content), err)
+		}
+		first.Close()
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 0 {
+			t.Errorf("Expected fragments to be reclaimed, got %d", n)
+		}
+	})
+
+	t.Run("ReplacedVersions", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		writeFile(t, sfs, "doc.bin", data)
+
+		// Nothing reads the old version, so it goes right away
+		writeFile(t, sfs, "doc.bin", data)
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 5 {
+			t.Errorf("Expected only the current version's fragments, got %d", n)
+		}
+
+		file := mustOpen(t, sfs, "doc.bin")
+		writeFile(t, sfs, "doc.bin", newData)
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 6 {
+			t.Errorf("Expected the open version to be kept, got %d fragments", n)
+		}
+
+		content, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the replaced content: %d bytes, %v", len(content), err)
+		}
+		file.Close()
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 1 {
+			t.Errorf("Expected the replaced version to be reclaimed, got %d fragments", n)
+		}
+	})
+
+	t.Run("DefaultRemoveIsImmediate", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		writeFile(t, sfs, "now.bin", data)
+
+		mustOpen(t, sfs, "now.bin")
+		if err := sfs.Remove("now.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 0 {
+			t.Errorf("Expected fragments to be deleted by Remove, got %d", n)
+		}
+	})
+
+	t.Run("MissingFragments", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		writeFile(t, sfs, "doc.bin", data)
+
+		file := mustOpen(t, sfs, "doc.bin")
+		if _, err := db.Exec("DELETE FROM file_fragments WHERE fragment_index >= 2"); err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(file)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected ErrUnexpectedEOF after %d bytes, got %v", len(content), err)
+		}
+		buf := make([]byte, 100)
+		if _, err := file.(io.ReaderAt).ReadAt(buf, int64(len(data)-100)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected ReadAt to fail with ErrUnexpectedEOF, got %v", err)
+		}
+	})
+
+	t.Run("SharedDatabase", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "shared.db")
+		first, db := openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		defer first.Close()
+		writeFile(t, first, "doc.bin", data)
+
+		// An overwritten version still open and an upload older than an hour
+		file := mustOpen(t, first, "doc.bin")
+		writeFile(t, first, "doc.bin", newData)
+		writer := first.NewWriter("upload.bin")
+		if _, err := writer.Write(data); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if _, err := db.Exec("UPDATE file_reclaim SET created_at = created_at - 7200"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Another instance starting up leaves both to their running owner
+		second, _ := openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		defer second.Close()
+		content, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the open version to survive another instance's start: %d bytes, %v", len(content), err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Expected the upload to commit: %v", err)
+		}
+		content, err = io.ReadAll(mustOpen(t, second, "upload.bin"))
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("Expected the upload to be complete: %d bytes, %v", len(content), err)
+		}
+		file.Close()
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_reclaim"); n != 0 {
+			t.Errorf("Expected an empty reclaim journal, got %d", n)
+		}
+	})
+
+	t.Run("CrashedInstance", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "crashed.db")
+		sfs, db := openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		defer sfs.Close()
+
+		// Entries of an instance whose lease expired and of one that is gone
+		now := time.Now().Unix()
+		if _, err := db.Exec("INSERT INTO file_instances (id, heartbeat) VALUES ('crashed', ?)", now-3600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO file_fragments (file_id, fragment_index, fragment) VALUES (9001, 0, x'00'), (9002, 0, x'00')"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO file_reclaim (file_id, reason, created_at, owner) VALUES (9001, 'upload', ?, 'crashed'), (9002, 'unlinked', ?, 'closed')", now, now); err != nil {
+			t.Fatal(err)
+		}
+
+		// The leftovers are reclaimed by the next instance, the live one stays
+		other, _ := openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		defer other.Close()
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE file_id IN (9001, 9002)"); n != 0 {
+			t.Errorf("Expected the crashed instances' fragments to be reclaimed, got %d", n)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_instances"); n != 2 {
+			t.Errorf("Expected only the running instances to stay registered, got %d", n)
+		}
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "readonly.db")
+		sfs, _ := openTestFS(t, path)
+		writeFile(t, sfs, "doc.bin", data)
+		if err := sfs.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, opts := range [][]sqlitefs.Option{nil, {sqlitefs.WithPOSIXUnlink()}} {
+			db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sfs, err := sqlitefs.NewSQLiteFS(db, opts...)
+			if err != nil {
+				t.Fatalf("Failed to open a read-only database: %v", err)
+			}
+			content, err := io.ReadAll(mustOpen(t, sfs, "doc.bin"))
+			if err != nil || !bytes.Equal(content, data) {
+				t.Errorf("Expected to read from a read-only database: %d bytes, %v", len(content), err)
+			}
+			if err := sfs.Close(); err != nil {
+				t.Errorf("Failed to close: %v", err)
+			}
+		}
+	})
+
+	t.Run("NoLeaseWithoutOption", func(t *testing.T) {
+		sfs, db := newTestFS(t)
+		writeFile(t, sfs, "doc.bin", data)
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_instances"); n != 0 {
+			t.Errorf("Expected no lease without WithPOSIXUnlink, got %d instances", n)
+		}
+	})
+
+	t.Run("CleanupOnStart", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "crash.db")
+		sfs, db := openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		writeFile(t, sfs, "open.bin", data)
+		writeFile(t, sfs, "kept.bin", newData)
+
+		// The handle is never closed, as if the process died
+		if _, err := sfs.Open("open.bin"); err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		if err := sfs.Remove("open.bin"); err != nil {
+			t.Fatalf("Failed to remove: %v", err)
+		}
+
+		// Uploads left behind by a crashed writer, one of them still recent
+		now := time.Now().Unix()
+		if _, err := db.Exec("INSERT INTO file_fragments (file_id, fragment_index, fragment) VALUES (9001, 0, x'00'), (9002, 0, x'00')"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO file_reclaim (file_id, reason, created_at) VALUES (9001, 'upload', ?), (9002, 'upload', ?)", now-2*3600, now); err != nil {
+			t.Fatal(err)
+		}
+		sfs.Close()
+
+		sfs, db = openTestFS(t, path, sqlitefs.WithPOSIXUnlink())
+		defer sfs.Close()
+
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE file_id != 9002"); n != 1 {
+			t.Errorf("Expected only kept.bin's fragment besides the recent upload, got %d", n)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments WHERE file_id = 9002"); n != 1 {
+			t.Error("Expected a recent upload to survive, it may belong to another process")
+		}
+		content, err := io.ReadAll(mustOpen(t, sfs, "kept.bin"))
+		if err != nil || !bytes.Equal(content, newData) {
+			t.Errorf("Expected kept.bin to be intact: %q, %v", content, err)
+		}
+	})
+}
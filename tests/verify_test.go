@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestExpectedContent tests that writers verify the expected digest and
+// size before committing
+func TestExpectedContent(t *testing.T) {
+	db := openTestDB(t)
+	sfs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithInlineStorage(100))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	original := []byte("original content")
+	large := bytes.Repeat([]byte("upload "), 10000) // 5 fragments
+	largeSum := sha256.Sum256(large)
+	small := []byte("tiny")
+	smallSum := sha256.Sum256(small)
+
+	writer := sfs.NewWriter("upload.bin")
+	writer.Write(original)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// unchanged checks that a failed upload left the previous content and
+	// no storage behind
+	unchanged := func(t *testing.T) {
+		t.Helper()
+		content, err := io.ReadAll(mustOpen(t, sfs, "upload.bin"))
+		if err != nil || !bytes.Equal(content, original) {
+			t.Errorf("Expected the original content to stay: %q, %v", content, err)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != 0 {
+			t.Errorf("Expected the upload's fragments to be discarded, got %d", n)
+		}
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_reclaim"); n != 0 {
+			t.Errorf("Expected an empty reclaim journal, got %d", n)
+		}
+	}
+
+	t.Run("DigestMismatch", func(t *testing.T) {
+		// Fragmented and inline content, each announced with the other's digest
+		for _, c := range []struct{ data, sum []byte }{{large, smallSum[:]}, {small, largeSum[:]}} {
+			writer := sfs.NewWriter("upload.bin", sqlitefs.WithExpectedSHA256(c.sum))
+			if _, err := writer.Write(c.data); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := writer.Close(); !errors.Is(err, sqlitefs.ErrDigestMismatch) {
+				t.Errorf("Expected ErrDigestMismatch, got %v", err)
+			}
+			unchanged(t)
+		}
+	})
+
+	t.Run("SizeMismatch", func(t *testing.T) {
+		// Too short is detected by Close
+		writer := sfs.NewWriter("upload.bin", sqlitefs.WithExpectedSize(int64(len(large))+1))
+		writer.Write(large)
+		if err := writer.Close(); !errors.Is(err, sqlitefs.ErrSizeMismatch) {
+			t.Errorf("Expected ErrSizeMismatch from Close, got %v", err)
+		}
+		unchanged(t)
+
+		// Too long is detected while writing
+		writer = sfs.NewWriter("upload.bin", sqlitefs.WithExpectedSize(20000))
+		if _, err := writer.Write(large); !errors.Is(err, sqlitefs.ErrSizeMismatch) {
+			t.Errorf("Expected ErrSizeMismatch from Write, got %v", err)
+		}
+		if err := writer.Close(); !errors.Is(err, sqlitefs.ErrSizeMismatch) {
+			t.Errorf("Expected ErrSizeMismatch from Close, got %v", err)
+		}
+		unchanged(t)
+
+		writer = sfs.NewWriter("upload.bin", sqlitefs.WithExpectedSize(3))
+		writer.Write(small)
+		if err := writer.Close(); !errors.Is(err, sqlitefs.ErrSizeMismatch) {
+			t.Errorf("Expected ErrSizeMismatch for inline content, got %v", err)
+		}
+		unchanged(t)
+	})
+
+	t.Run("Match", func(t *testing.T) {
+		writer := sfs.NewWriter("upload.bin",
+			sqlitefs.WithExpectedSHA256(largeSum[:]),
+			sqlitefs.WithExpectedSize(int64(len(large))))
+		if _, err := writer.ReadFrom(bytes.NewReader(large)); err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Expected a matching upload to commit: %v", err)
+		}
+		content, err := io.ReadAll(mustOpen(t, sfs, "upload.bin"))
+		if err != nil || !bytes.Equal(content, large) {
+			t.Errorf("Expected the uploaded content: %d bytes, %v", len(content), err)
+		}
+
+		writer = sfs.NewWriter("small.txt", sqlitefs.WithExpectedSHA256(smallSum[:]), sqlitefs.WithExpectedSize(4))
+		writer.Write(small)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Expected a matching inline upload to commit: %v", err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestWalkDir tests that SQLiteFS.WalkDir visits the same entries in the
+// same order as fs.WalkDir, including skips
+func TestWalkDir(t *testing.T) {
+	sfs, err := sqlitefs.NewSQLiteFS(openTestDB(t), sqlitefs.WithInlineStorage(64))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer sfs.Close()
+
+	files := map[string][]byte{
+		"a.txt":           []byte("root file"),
+		"docs/readme.md":  []byte("readme"),
+		"docs/api/v1.md":  bytes.Repeat([]byte("v1 "), 10000),
+		"docs/api/v2.md":  []byte("v2"),
+		"docs/zz.html":    []byte("<html>"),
+		"docs-old/x.txt":  []byte("x"),
+		"docs.txt":        []byte("not a directory"),
+		"img/logo.png":    bytes.Repeat([]byte{0x89}, 40000),
+		"img/deep/a/b/c":  []byte("deep"),
+		"z/last.txt":      []byte("last"),
+		"z/sub/empty.txt": nil,
+	}
+	for path, data := range files {
+		writer := sfs.NewWriter(path)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	// record returns a WalkDirFunc appending visits to out and returning
+	// the error chosen by decide
+	record := func(out *[]string, decide func(path string, d fs.DirEntry) error) fs.WalkDirFunc {
+		return func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				*out = append(*out, "error:"+path)
+				return err
+			}
+			*out = append(*out, fmt.Sprintf("%s dir=%v", path, d.IsDir()))
+			if decide != nil {
+				return decide(path, d)
+			}
+			return nil
+		}
+	}
+	compare := func(t *testing.T, root string, decide func(path string, d fs.DirEntry) error) {
+		t.Helper()
+		var want, got []string
+		wantErr := fs.WalkDir(sfs, root, record(&want, decide))
+		gotErr := sfs.WalkDir(root, record(&got, decide))
+		if !slices.Equal(got, want) {
+			t.Errorf("WalkDir(%s) visited\n%s\nwant\n%s", root, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		if (gotErr == nil) != (wantErr == nil) {
+			t.Errorf("WalkDir(%s) returned %v, want %v", root, gotErr, wantErr)
+		}
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		for _, root := range []string{".", "docs", "docs/api", "img/deep", "a.txt"} {
+			compare(t, root, nil)
+		}
+	})
+
+	t.Run("SkipDir", func(t *testing.T) {
+		compare(t, ".", func(path string, d fs.DirEntry) error {
+			if path == "docs/api" || path == "img" {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		// On a file, the rest of its directory is skipped
+		compare(t, ".", func(path string, d fs.DirEntry) error {
+			if path == "docs/api/v1.md" || path == "z/last.txt" {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		compare(t, "docs", func(path string, d fs.DirEntry) error {
+			if path == "docs/readme.md" {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		compare(t, "docs", func(path string, d fs.DirEntry) error {
+			if path == "docs" {
+				return fs.SkipDir
+			}
+			return nil
+		})
+	})
+
+	t.Run("SkipAll", func(t *testing.T) {
+		compare(t, ".", func(path string, d fs.DirEntry) error {
+			if path == "docs/api/v2.md" {
+				return fs.SkipAll
+			}
+			return nil
+		})
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		compare(t, "missing", nil)
+
+		stop := errors.New("stop")
+		err := sfs.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+			if path == "img/logo.png" {
+				return stop
+			}
+			return nil
+		})
+		if err != stop {
+			t.Errorf("Expected the callback's error, got %v", err)
+		}
+	})
+
+	t.Run("Info", func(t *testing.T) {
+		err := sfs.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if want := int64(len(files[path])); info.Size() != want {
+				t.Errorf("%s: expected size %d, got %d", path, want, info.Size())
+			}
+			mimeType := info.(sqlitefs.MIMETyper).MIMEType()
+			switch {
+			case strings.HasSuffix(path, ".png") && mimeType != "image/png",
+				strings.HasSuffix(path, ".html") && !strings.HasPrefix(mimeType, "text/html"),
+				mimeType == "":
+				t.Errorf("%s: unexpected MIME type %q", path, mimeType)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WalkDir: %v", err)
+		}
+
+		info, err := fs.Stat(sfs, "img/logo.png")
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if mimeType := info.(sqlitefs.MIMETyper).MIMEType(); mimeType != "image/png" {
+			t.Errorf("Expected Stat to report image/png, got %q", mimeType)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestWriterModes tests concurrent writers for the same path
+func TestWriterModes(t *testing.T) {
+	const writers = 8
+	contents := make([][]byte, writers)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, 16*1024*3+i*1000)
+	}
+
+	// matchesOne reports whether data is exactly one writer's content
+	matchesOne := func(data []byte) bool {
+		for _, c := range contents {
+			if bytes.Equal(data, c) {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("LastCloseWins", func(t *testing.T) {
+		db := openTestDB(t)
+		sfs, err := sqlitefs.NewSQLiteFS(db)
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		defer sfs.Close()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(data []byte) {
+				defer wg.Done()
+				writer := sfs.NewWriter("race.bin")
+				// Small writes interleave the writers' fragments
+				for off := 0; off < len(data); off += 5000 {
+					writer.Write(data[off:min(off+5000, len(data))])
+				}
+				errs <- writer.Close()
+			}(contents[i])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Writer failed: %v", err)
+			}
+		}
+
+		content, err := io.ReadAll(mustOpen(t, sfs, "race.bin"))
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !matchesOne(content) {
+			t.Errorf("Expected one writer's complete content, got a mix of %d bytes", len(content))
+		}
+
+		// Only the winning version is left in storage
+		want := (len(content) + 16*1024 - 1) / (16 * 1024)
+		if n := countRows(t, db, "SELECT COUNT(*) FROM file_fragments"); n != want {
+			t.Errorf("Expected %d fragments, got %d", want, n)
+		}
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		sfs, err := sqlitefs.NewSQLiteFS(openTestDB(t), sqlitefs.WithWriterMode(sqlitefs.WriteExclusive))
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		defer sfs.Close()
+
+		first := sfs.NewWriter("locked.bin")
+		first.Write(contents[0])
+
+		second := sfs.NewWriter("locked.bin")
+		if _, err := second.Write(contents[1]); !errors.Is(err, sqlitefs.ErrWriteInProgress) {
+			t.Errorf("Expected ErrWriteInProgress from Write, got %v", err)
+		}
+		if err := second.Close(); !errors.Is(err, sqlitefs.ErrWriteInProgress) {
+			t.Errorf("Expected ErrWriteInProgress from Close, got %v", err)
+		}
+
+		// Other paths are not affected
+		other := sfs.NewWriter("other.bin")
+		other.Write(contents[2])
+		if err := other.Close(); err != nil {
+			t.Errorf("Failed to write another path: %v", err)
+		}
+
+		if err := first.Close(); err != nil {
+			t.Fatalf("Failed to close first writer: %v", err)
+		}
+		content, err := io.ReadAll(mustOpen(t, sfs, "locked.bin"))
+		if err != nil || !bytes.Equal(content, contents[0]) {
+			t.Errorf("Expected the first writer's content: %d bytes, %v", len(content), err)
+		}
+
+		// The path is free again once the writer is closed
+		third := sfs.NewWriter("locked.bin")
+		third.Write(contents[3])
+		if err := third.Close(); err != nil {
+			t.Errorf("Expected a new writer after close to succeed: %v", err)
+		}
+	})
+
+	t.Run("ExclusiveRace", func(t *testing.T) {
+		sfs, err := sqlitefs.NewSQLiteFS(openTestDB(t), sqlitefs.WithWriterMode(sqlitefs.WriteExclusive))
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		defer sfs.Close()
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var committed [][]byte
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(data []byte) {
+				defer wg.Done()
+				writer := sfs.NewWriter("race.bin")
+				writer.Write(data)
+				err := writer.Close()
+				switch {
+				case err == nil:
+					mu.Lock()
+					committed = append(committed, data)
+					mu.Unlock()
+				case !errors.Is(err, sqlitefs.ErrWriteInProgress):
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}(contents[i])
+		}
+		wg.Wait()
+
+		if len(committed) == 0 {
+			t.Fatal("Expected at least one writer to succeed")
+		}
+		content, err := io.ReadAll(mustOpen(t, sfs, "race.bin"))
+		if err != nil || !matchesOne(content) {
+			t.Errorf("Expected one writer's complete content: %d bytes, %v", len(content), err)
+		}
+	})
+}
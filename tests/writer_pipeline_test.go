@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jilio/sqlitefs"
+	_ "modernc.org/sqlite"
+)
+
+// TestPipelinedWriter tests writers that keep several fragments in flight
+func TestPipelinedWriter(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:pipelined?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	fs, err := sqlitefs.NewSQLiteFS(db, sqlitefs.WithWriteInFlight(8))
+	if err != nil {
+		t.Fatalf("Failed to create SQLiteFS: %v", err)
+	}
+	defer fs.Close()
+
+	t.Run("OrderPreserved", func(t *testing.T) {
+		data := make([]byte, 16*1024*20+123)
+		for i := range data {
+			data[i] = byte(i / 16384)
+		}
+
+		writer := fs.NewWriter("pipelined.bin")
+		// Write in odd-sized chunks so fragments straddle Write calls
+		for off := 0; off < len(data); off += 5000 {
+			end := min(off+5000, len(data))
+			if _, err := writer.Write(data[off:end]); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		file, err := fs.Open("pipelined.bin")
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer file.Close()
+
+		got, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Content mismatch: got %d bytes, want %d", len(got), len(data))
+		}
+	})
+
+	t.Run("ErrorSurfaced", func(t *testing.T) {
+		writer := fs.NewWriter("broken.bin")
+		if _, err := writer.Write(make([]byte, 16*1024)); err != nil {
+			t.Fatalf("Failed to write first fragment: %v", err)
+		}
+
+		// Break fragment storage while fragments are still being queued
+		if _, err := db.Exec("ALTER TABLE file_fragments RENAME TO file_fragments_moved"); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Exec("ALTER TABLE file_fragments_moved RENAME TO file_fragments")
+
+		// Queue a fragment that fails, then keep writing less than a
+		// fragment so the in-flight window never fills up
+		_, writeErr := writer.Write(make([]byte, 16*1024))
+		for deadline := time.Now().Add(5 * time.Second); writeErr == nil && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			_, writeErr = writer.Write([]byte{0})
+		}
+		if writeErr == nil {
+			t.Error("Expected a later Write to report the failed fragment")
+		}
+		if err := writer.Close(); err == nil {
+			t.Error("Expected Close to report the failed fragment as well")
+		}
+
+		if _, err := writer.Write([]byte("more")); err == nil {
+			t.Error("Expected error when writing after a failed close")
+		}
+	})
+
+	t.Run("Synchronous", func(t *testing.T) {
+		db2, err := sql.Open("sqlite", "file:pipelined_sync?mode=memory&cache=shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db2.Close()
+
+		fs2, err := sqlitefs.NewSQLiteFS(db2, sqlitefs.WithWriteInFlight(0))
+		if err != nil {
+			t.Fatalf("Failed to create SQLiteFS: %v", err)
+		}
+		defer fs2.Close()
+
+		data := bytes.Repeat([]byte("sync"), 10000)
+		writer := fs2.NewWriter("sync.txt")
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		got, err := io.ReadAll(mustOpen(t, fs2, "sync.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("Content mismatch for synchronous writer")
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reasons recorded in file_reclaim.
+const (
+	reclaimUpload   = "upload"   // reserved by a writer that has not committed yet
+	reclaimUnlinked = "unlinked" // replaced or removed, waiting for its handles to close
+)
+
+// instanceSchema lists the SQLiteFS instances using the database with
+// WithPOSIXUnlink. Each one renews its heartbeat while open, so entries of
+// file_reclaim are only reclaimed by another instance once their owner is
+// gone.
+const instanceSchema = `
+	CREATE TABLE IF NOT EXISTS file_instances (
+		id TEXT PRIMARY KEY,
+		heartbeat INTEGER NOT NULL
+	);
+`
+
+const (
+	// leaseRenewal is how often an instance renews its heartbeat.
+	leaseRenewal = time.Minute
+	// leaseTimeout is how long a heartbeat stays valid. An instance that
+	// missed it is treated as crashed, and its entries are reclaimed.
+	leaseTimeout = 10 * time.Minute
+)
+
+// staleUploadAge is how old a file_reclaim entry without an owner, written
+// by an older version or an instance without a lease, must be before it is
+// reclaimed. Younger ones may still belong to another process sharing the
+// database.
+const staleUploadAge = time.Hour
+
+// errUploadReclaimed is returned by a commit whose fragments were already
+// reclaimed as a stale upload.
+var errUploadReclaimed = errors.New("sqlitefs: upload was reclaimed before commit")
+
+// versionTracker counts open handles per file id, so the fragments of a
+// version that was replaced or removed are only deleted once the last handle
+// reading it is closed. Handles are tracked within this process only.
+type versionTracker struct {
+	mu       sync.Mutex
+	open     map[int64]int  // file id -> open handles
+	unlinked map[int64]bool // unlinked ids waiting for their handles to close
+	reclaims uint64         // number of reclaims started, see acquire
+	closed   bool           // the filesystem is closed, nothing is reclaimed
+}
+
+func newVersionTracker() *versionTracker {
+	return &versionTracker{
+		open:     make(map[int64]int),
+		unlinked: make(map[int64]bool),
+	}
+}
+
+// generation returns a value that changes whenever a reclaim starts.
+func (t *versionTracker) generation() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reclaims
+}
+
+// acquire registers a handle on fileID. It fails when a reclaim started
+// since gen was taken, in which case the caller must look the path up again
+// because the version it found may be gone.
+func (t *versionTracker) acquire(fileID int64, gen uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reclaims != gen {
+		return false
+	}
+	t.open[fileID]++
+	return true
+}
+
+// release unregisters a handle and reports whether the version must be
+// reclaimed now.
+func (t *versionTracker) release(fileID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[fileID]--
+	if t.open[fileID] > 0 {
+		return false
+	}
+	delete(t.open, fileID)
+	if !t.unlinked[fileID] || t.closed {
+		return false
+	}
+	delete(t.unlinked, fileID)
+	t.reclaims++
+	return true
+}
+
+// unlink marks fileID as no longer reachable by path and reports whether it
+// can be reclaimed right away.
+func (t *versionTracker) unlink(fileID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.open[fileID] > 0 {
+		t.unlinked[fileID] = true
+		return false
+	}
+	t.reclaims++
+	return true
+}
+
+// close stops all further reclaims; versions still unlinked are reclaimed
+// by the next NewSQLiteFS once the instance is unregistered.
+func (t *versionTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+}
+
+// unlinkVersion is called once a version has been replaced or removed. Its
+// fragments are deleted now, or by the last open handle's Close.
+func (fs *SQLiteFS) unlinkVersion(fileID int64) error {
+	if fs.versions.unlink(fileID) {
+		return fs.reclaim(fileID)
+	}
+	return nil
+}
+
+// releaseVersion is called when a handle on fileID is closed.
+func (fs *SQLiteFS) releaseVersion(fileID int64) error {
+	if fs.versions.release(fileID) {
+		return fs.reclaim(fileID)
+	}
+	return nil
+}
+
+// reclaim deletes the fragments of a version nobody reads anymore together
+// with its file_reclaim entry.
+func (fs *SQLiteFS) reclaim(fileID int64) error {
+	err := fs.retry(context.Background(), func() error {
+		tx, err := fs.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Stmt(fs.stmts.deleteFragmentsByID).Exec(fileID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(fs.stmts.deleteReclaim).Exec(fileID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.invalidateFile(fileID)
+	return nil
+}
+
+// register adds the instance to file_instances under a new random id. A
+// read-only database leaves the instance without a lease, which is all it
+// needs as it never journals anything.
+func (fs *SQLiteFS) register() error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	fs.instance = hex.EncodeToString(id)
+	fs.leaseDone = make(chan struct{})
+	err := fs.heartbeat()
+	if isReadOnly(err) {
+		fs.instance = ""
+		return nil
+	}
+	return err
+}
+
+// owner returns the owner recorded with the instance's file_reclaim entries,
+// NULL without a lease. Entries without an owner are reclaimed once they are
+// staleUploadAge old.
+func (fs *SQLiteFS) owner() any {
+	if fs.instance == "" {
+		return nil
+	}
+	return fs.instance
+}
+
+// heartbeat records that the instance is alive. It adds the instance again
+// if another one took it for crashed, so later entries are protected anew.
+func (fs *SQLiteFS) heartbeat() error {
+	return fs.retry(context.Background(), func() error {
+		_, err := fs.db.Exec(`INSERT OR REPLACE INTO file_instances (id, heartbeat) VALUES (?, ?)`, fs.instance, time.Now().Unix())
+		return err
+	})
+}
+
+// renewLease renews the heartbeat until Close. A failed renewal is retried
+// on the next tick, well before the lease times out.
+func (fs *SQLiteFS) renewLease() {
+	defer fs.leaseWg.Done()
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.leaseDone:
+			return
+		case <-ticker.C:
+			fs.heartbeat()
+		}
+	}
+}
+
+// unregister removes the instance from file_instances, which hands its
+// remaining file_reclaim entries to the next NewSQLiteFS.
+func (fs *SQLiteFS) unregister() error {
+	return fs.retry(context.Background(), func() error {
+		_, err := fs.db.Exec(`DELETE FROM file_instances WHERE id = ?`, fs.instance)
+		return err
+	})
+}
+
+// reclaimLeftovers deletes what instances that are gone left behind:
+// versions that were unlinked while handles were open and uploads that
+// never committed. Entries of running instances are left alone.
+func (fs *SQLiteFS) reclaimLeftovers() error {
+	var ids []int64
+	expired := time.Now().Add(-leaseTimeout).Unix()
+	err := fs.retry(context.Background(), func() error {
+		ids = ids[:0]
+		rows, err := fs.stmts.reclaimable.Query(time.Now().Add(-staleUploadAge).Unix(), expired)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fileID int64
+			if err := rows.Scan(&fileID); err != nil {
+				return err
+			}
+			ids = append(ids, fileID)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fileID := range ids {
+		if err := fs.reclaim(fileID); err != nil {
+			return err
+		}
+	}
+	return fs.retry(context.Background(), func() error {
+		_, err := fs.db.Exec(`DELETE FROM file_instances WHERE heartbeat < ?`, expired)
+		return err
+	})
+}
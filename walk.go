@@ -0,0 +1,121 @@
+package sqlitefs
+
+import (
+	"context"
+	iofs "io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// walkRow is one file_metadata row loaded by WalkDir.
+type walkRow struct {
+	path     string
+	mimeType string
+	sha256   []byte
+	size     int64
+}
+
+// WalkDir walks the tree rooted at root like fs.WalkDir, calling fn for
+// each file and directory in the same order and honouring fs.SkipDir and
+// fs.SkipAll. Instead of a ReadDir per directory and a size query per file,
+// the paths, sizes and MIME types of the whole tree are loaded with a single
+// query before fn is first called for an entry below root; the file infos
+// implement MIMETyper.
+func (fs *SQLiteFS) WalkDir(root string, fn iofs.WalkDirFunc) error {
+	info, err := iofs.Stat(fs, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, iofs.FileInfoToDirEntry(info), nil)
+		if err == nil && info.IsDir() {
+			err = fs.walkTree(root, info, fn)
+		}
+	}
+	if err == iofs.SkipDir || err == iofs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkTree calls fn for everything below the directory root.
+func (fs *SQLiteFS) walkTree(root string, rootInfo iofs.FileInfo, fn iofs.WalkDirFunc) error {
+	prefix := dirPrefix(root)
+	var rows []walkRow
+	err := fs.retry(context.Background(), func() error {
+		rows = rows[:0]
+		result, err := fs.stmts.walkTree.Query(prefix, prefixEnd(prefix))
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		for result.Next() {
+			var row walkRow
+			if err := result.Scan(&row.path, &row.mimeType, &row.sha256, &row.size); err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return result.Err()
+	})
+	if err != nil {
+		// Reported like a failed ReadDir of root
+		return fn(root, iofs.FileInfoToDirEntry(rootInfo), err)
+	}
+
+	now := time.Now()
+	var dirs []string // entered directories, outermost first
+	skip := ""        // directory whose remaining contents are skipped
+	for _, row := range rows {
+		if skip != "" && strings.HasPrefix(row.path, skip) {
+			continue
+		}
+		skip = ""
+		for len(dirs) > 0 && !strings.HasPrefix(row.path, dirs[len(dirs)-1]) {
+			dirs = dirs[:len(dirs)-1]
+		}
+
+		// Visit the directories this path is in the first time they show up
+		entered := true
+		for i := len(prefix); i < len(row.path); i++ {
+			if row.path[i] != '/' {
+				continue
+			}
+			dirPath := row.path[:i+1]
+			if len(dirs) > 0 && len(dirPath) <= len(dirs[len(dirs)-1]) {
+				continue
+			}
+			info := &fileInfo{name: baseName(dirPath), modTime: now, isDir: true}
+			err := fn(path.Join(root, dirPath[len(prefix):]), iofs.FileInfoToDirEntry(info), nil)
+			if err == iofs.SkipDir {
+				skip = dirPath
+				entered = false
+				break
+			}
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dirPath)
+		}
+		if !entered || strings.HasSuffix(row.path, "/") {
+			continue
+		}
+
+		info := &fileInfo{name: baseName(row.path), size: row.size, modTime: now, mimeType: row.mimeType, sha256: row.sha256}
+		err := fn(path.Join(root, row.path[len(prefix):]), iofs.FileInfoToDirEntry(info), nil)
+		if err == iofs.SkipDir {
+			// Skip the rest of the containing directory
+			parent := row.path[:strings.LastIndexByte(row.path, '/')+1]
+			if len(parent) <= len(prefix) {
+				return nil
+			}
+			skip = parent
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,108 +1,429 @@
 package sqlitefs
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
 	"errors"
-	"mime"
-	"path/filepath"
+	"fmt"
+	"hash"
+	"io"
 )
 
 const fragmentSize = 16 * 1024 // 16 КБ
 
+var _ io.ReaderFrom = (*SQLiteWriter)(nil)
+
+// WriterMode defines the outcome of concurrent writers for one path.
+type WriterMode int
+
+const (
+	// WriteLastCloseWins lets any number of writers work on a path at once.
+	// Each one writes a version of its own that nobody sees before Close;
+	// the path ends up with the content of the writer closed last.
+	WriteLastCloseWins WriterMode = iota
+
+	// WriteExclusive allows one writer per path at a time within this
+	// SQLiteFS. Writers created while another is open fail with
+	// ErrWriteInProgress and leave the path untouched.
+	WriteExclusive
+)
+
+// ErrWriteInProgress is reported by a writer in WriteExclusive mode when its
+// path already has an open writer.
+var ErrWriteInProgress = errors.New("sqlitefs: path is already being written")
+
+// Errors reported by writers whose content does not match what was
+// announced with WithExpectedSHA256 or WithExpectedSize.
+var (
+	ErrDigestMismatch = errors.New("sqlitefs: content digest mismatch")
+	ErrSizeMismatch   = errors.New("sqlitefs: content size mismatch")
+)
+
+// SQLiteWriter writes a new version of a file. Fragments are stored under a
+// file id of their own and the path is switched to it in one step by Close,
+// so readers never observe a partially written file.
 type SQLiteWriter struct {
 	fs            *SQLiteFS
 	path          string
-	buffer        []byte
-	fragmentSize  int
+	buffer        []byte   // pending fragment, never longer than fragmentSize
+	fragmentSize  int      // longest fragment, Chunking.Max for chunked files
+	chunker       *chunker // content-defined boundaries, nil for fixed-size fragments
 	fragmentIndex int
-	fileCreated   bool
+	fileID        int64 // id of the version being written, 0 until reserved
 	closed        bool
+	ownsPath      bool        // holds the path in WriteExclusive mode
+	hash          hash.Hash   // SHA-256 of everything stored so far
+	size          int64       // bytes stored so far
+	codec         Codec       // compresses each fragment, nil to store them as they are
+	aead          cipher.AEAD // encrypts each fragment, nil if encryption is disabled
+	keyID         string      // master key wrapping dataKey
+	dataKey       []byte      // data key of aead, wrapped
+	dedup         bool        // store fragments once per content hash
+	blobCommit    bool        // commit to content_blobs instead of a path, see PutBlob
+
+	expectSHA256 []byte // digest verified by Close, nil if not given
+	expectSize   int64  // exact size required, -1 if not given
+
+	// Fragments are queued to the writer goroutine without waiting for each
+	// one to be stored; respCh collects their results in submission order.
+	// Each queued fragment owns its buffer until its result arrives, after
+	// which the buffer is reused, so memory stays bounded by the window.
+	respCh  chan writeResult
+	pending [][]byte // buffers of queued fragments, oldest first
+	free    [][]byte // buffers ready for reuse
+	err     error    // first error reported for a queued fragment
 }
 
 // NewSQLiteWriter creates a new SQLiteWriter for the specified path.
 // Deprecated: Use SQLiteFS.NewWriter instead.
 func NewSQLiteWriter(fs *SQLiteFS, path string) *SQLiteWriter {
-	return &SQLiteWriter{
+	w := newWriter(fs, path)
+	if fs.writerMode == WriteExclusive {
+		if fs.claimPath(path) {
+			w.ownsPath = true
+		} else {
+			w.err = &PathError{Op: "write", Path: path, Err: ErrWriteInProgress}
+		}
+	}
+	return w
+}
+
+// newWriter creates a writer without claiming its path.
+func newWriter(fs *SQLiteFS, path string) *SQLiteWriter {
+	maxInFlight := fs.writeInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	w := &SQLiteWriter{
 		fs:           fs,
 		path:         path,
 		fragmentSize: fragmentSize,
 		buffer:       make([]byte, 0, fragmentSize),
+		hash:         sha256.New(),
+		codec:        fs.codecForType(detectMIMEType(path)),
+		dedup:        fs.dedup,
+		expectSize:   -1,
+		respCh:       make(chan writeResult, maxInFlight),
+	}
+	if fs.chunking != (Chunking{}) {
+		w.setChunking(fs.chunking)
+	}
+
+	if fs.keys != nil {
+		var err error
+		w.aead, w.keyID, w.dataKey, err = fs.newDataKey(context.Background())
+		if err != nil {
+			w.err = &PathError{Op: "write", Path: path, Err: err}
+		}
 	}
+	return w
 }
 
 func (w *SQLiteWriter) Write(p []byte) (n int, err error) {
 	if w.closed {
 		return 0, errors.New("sqlitefs: write to closed writer")
 	}
+	w.poll()
+	if w.err != nil {
+		return 0, w.err
+	}
 
-	n = len(p)
-	w.buffer = append(w.buffer, p...)
+	for len(p) > 0 {
+		copied := copy(w.buffer[len(w.buffer):w.fragmentSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+copied]
+		p = p[copied:]
+		n += copied
 
-	for len(w.buffer) >= w.fragmentSize {
-		err = w.writeFragment()
-		if err != nil {
-			return len(p) - len(w.buffer), err
+		if err = w.writeComplete(); err != nil {
+			return n, err
 		}
 	}
 
 	return n, nil
 }
 
-func (w *SQLiteWriter) writeFragment() error {
-	if !w.fileCreated {
-		err := w.createFileRecord()
-		if err != nil {
+// ReadFrom implements io.ReaderFrom. It reads from r straight into
+// fragment-sized buffers until EOF, so copying a file of any size uses a
+// bounded amount of memory. The writer is not closed.
+func (w *SQLiteWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.closed {
+		return 0, errors.New("sqlitefs: write to closed writer")
+	}
+	w.poll()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	for {
+		read, readErr := r.Read(w.buffer[len(w.buffer):w.fragmentSize])
+		w.buffer = w.buffer[:len(w.buffer)+read]
+		n += int64(read)
+
+		if err = w.writeComplete(); err != nil {
+			return n, err
+		}
+
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
+
+// setChunking switches the writer to content-defined chunking, or back to
+// fixed-size fragments for the zero Chunking. Nothing may be buffered yet.
+func (w *SQLiteWriter) setChunking(c Chunking) {
+	w.chunker, w.fragmentSize = nil, fragmentSize
+	if c != (Chunking{}) {
+		if err := c.validate(); err != nil {
+			if w.err == nil {
+				w.err = &PathError{Op: "write", Path: w.path, Err: err}
+			}
+			return
+		}
+		w.chunker, w.fragmentSize = newChunker(c), c.Max
+	}
+	w.buffer, w.free = make([]byte, 0, w.fragmentSize), nil
+}
+
+// writeComplete queues every complete fragment at the start of the buffer:
+// a full one for fixed-size fragments, each chunk found so far otherwise.
+func (w *SQLiteWriter) writeComplete() error {
+	for {
+		n := 0
+		if w.chunker != nil {
+			n = w.chunker.cut(w.buffer)
+		} else if len(w.buffer) == w.fragmentSize {
+			n = len(w.buffer)
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := w.writeFragment(n); err != nil {
 			return err
 		}
-		w.fileCreated = true
+	}
+}
+
+// writeFragment queues the first n buffered bytes as a fragment and keeps
+// the rest buffered. It only blocks when the writer already has the maximum
+// number of fragments in flight, and returns the first error reported by
+// any earlier fragment.
+func (w *SQLiteWriter) writeFragment(n int) error {
+	if w.fileID == 0 {
+		res := w.request(writeRequest{op: opReserve})
+		if res.err != nil {
+			w.err = res.err
+			return res.err
+		}
+		w.fileID = res.fileID
 	}
 
-	writeSize := min(len(w.buffer), w.fragmentSize)
+	if len(w.pending) == cap(w.respCh) {
+		w.collect()
+	}
+	if w.err != nil {
+		return w.err
+	}
 
-	respCh := make(chan error)
+	offset := w.size
+	w.size += int64(n)
+	if w.expectSize >= 0 && w.size > w.expectSize {
+		w.err = w.mismatch(ErrSizeMismatch, w.expectSize, fmt.Sprintf("more than %d", w.expectSize))
+		return w.err
+	}
+	data := w.buffer[:n]
+	w.hash.Write(data)
+	if w.codec != nil {
+		compressed, err := w.codec.Compress(nil, data)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		data = compressed
+	}
+	if w.aead != nil {
+		sealed, err := seal(w.aead, data, fragmentAAD(w.fileID, int64(w.fragmentIndex)))
+		if err != nil {
+			w.err = err
+			return err
+		}
+		data = sealed
+	}
+	// Encrypted fragments never repeat, so deduplicating them is pointless
+	var blob []byte
+	if w.dedup && w.aead == nil {
+		sum := sha256.Sum256(data)
+		blob = sum[:]
+	}
 	w.fs.writeCh <- writeRequest{
-		path:   w.path,
-		data:   w.buffer[:writeSize],
-		index:  w.fragmentIndex,
-		respCh: respCh,
+		op:      opFragment,
+		fileID:  w.fileID,
+		data:    data,
+		index:   w.fragmentIndex,
+		offset:  offset,
+		chunked: w.chunker != nil,
+		blob:    blob,
+		respCh:  w.respCh,
 	}
-	err := <-respCh
+	rest := w.buffer[n:]
+	w.pending = append(w.pending, w.buffer)
+	w.fragmentIndex++
 
-	if err == nil {
-		w.buffer = w.buffer[writeSize:]
-		w.fragmentIndex++
+	// Continue in a recycled buffer with what follows the fragment; the
+	// queued fragment is only read until its result arrives
+	if last := len(w.free) - 1; last >= 0 {
+		w.buffer = w.free[last]
+		w.free = w.free[:last]
+	} else {
+		w.buffer = make([]byte, 0, w.fragmentSize)
 	}
+	w.buffer = append(w.buffer, rest...)
 
-	return err
+	return nil
+}
+
+// collect waits for the oldest queued fragment, records its error and
+// releases its buffer for reuse.
+func (w *SQLiteWriter) collect() {
+	w.release(<-w.respCh)
 }
 
-func (w *SQLiteWriter) createFileRecord() error {
-	ext := filepath.Ext(w.path)
-	mimeType := mime.TypeByExtension(ext)
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+// poll collects the results that have arrived already without waiting, so
+// a failed fragment fails the next Write rather than the one that finds
+// the window full.
+func (w *SQLiteWriter) poll() {
+	for len(w.pending) > 0 {
+		select {
+		case res := <-w.respCh:
+			w.release(res)
+		default:
+			return
+		}
 	}
+}
 
-	respCh := make(chan error)
-	w.fs.writeCh <- writeRequest{
-		path:     w.path,
-		mimeType: mimeType,
-		respCh:   respCh,
+// release records the result of the oldest queued fragment and frees its
+// buffer.
+func (w *SQLiteWriter) release(res writeResult) {
+	w.free = append(w.free, w.pending[0][:0])
+	w.pending = w.pending[1:]
+	if res.err != nil && w.err == nil {
+		w.err = res.err
+	}
+}
+
+// flush waits until every queued fragment has been stored.
+func (w *SQLiteWriter) flush() error {
+	for len(w.pending) > 0 {
+		w.collect()
+	}
+	return w.err
+}
+
+// request sends a single request to the writer goroutine and waits for it.
+func (w *SQLiteWriter) request(req writeRequest) writeResult {
+	req.path = w.path
+	return w.fs.request(req)
+}
+
+// commit binds the path to the written version together with its digest.
+// A non-nil inline slice is stored as the complete content of the file
+// instead.
+func (w *SQLiteWriter) commit(inline []byte) error {
+	if inline != nil {
+		w.size += int64(len(inline))
+		w.hash.Write(inline)
+	}
+	sum := w.hash.Sum(nil)
+	if w.expectSize >= 0 && w.size != w.expectSize {
+		return w.mismatch(ErrSizeMismatch, w.expectSize, w.size)
 	}
-	return <-respCh
+	if w.expectSHA256 != nil && !bytes.Equal(sum, w.expectSHA256) {
+		return w.mismatch(ErrDigestMismatch, fmt.Sprintf("%x", w.expectSHA256), fmt.Sprintf("%x", sum))
+	}
+
+	var codec string
+	if w.codec != nil && inline == nil {
+		codec = w.codec.Name()
+	}
+
+	op := opCommit
+	if w.blobCommit {
+		op = opCommitBlob
+	}
+	return w.request(writeRequest{
+		op:       op,
+		fileID:   w.fileID,
+		data:     inline,
+		mimeType: detectMIMEType(w.path),
+		sha256:   sum,
+		codec:    codec,
+		size:     w.size,
+		chunked:  w.chunker != nil && inline == nil,
+		keyID:    w.keyID,
+		dataKey:  w.dataKey,
+		inline:   inline != nil,
+	}).err
 }
 
+// Close stores the remaining data and commits the new version. If anything
+// failed the stored fragments are discarded and the path keeps its previous
+// content.
 func (w *SQLiteWriter) Close() error {
 	if w.closed {
 		return nil
 	}
+	w.closed = true
+	if w.ownsPath {
+		defer w.fs.releasePath(w.path)
+	}
 
-	for len(w.buffer) > 0 || !w.fileCreated {
-		err := w.writeFragment()
-		if err != nil {
-			return err
-		}
+	// Small files that never filled a fragment can live in their metadata
+	// row, unless they have to be encrypted or have no row
+	if w.err == nil && w.fileID == 0 && w.aead == nil && !w.blobCommit && w.fs.inlineMax > 0 && len(w.buffer) <= w.fs.inlineMax {
+		return w.commit(w.buffer)
 	}
 
-	w.closed = true
-	return nil
+	for (len(w.buffer) > 0 || w.fileID == 0) && w.err == nil {
+		w.writeFragment(len(w.buffer))
+	}
+
+	// Commit only once every fragment is durable.
+	err := w.flush()
+	if err == nil {
+		err = w.commit(nil)
+	}
+	if err != nil && w.fileID != 0 {
+		w.request(writeRequest{op: opDiscard, fileID: w.fileID})
+	}
+	return err
+}
+
+// mismatch builds the error for content that differs from what was
+// expected.
+func (w *SQLiteWriter) mismatch(err error, want, got any) error {
+	return &PathError{Op: "write", Path: w.path, Err: fmt.Errorf("%w: expected %v, got %v", err, want, got)}
+}
+
+// claimPath marks path as being written and reports whether it was free.
+func (fs *SQLiteFS) claimPath(path string) bool {
+	fs.writingMu.Lock()
+	defer fs.writingMu.Unlock()
+	if fs.writing[path] {
+		return false
+	}
+	fs.writing[path] = true
+	return true
+}
+
+// releasePath frees a path claimed by claimPath.
+func (fs *SQLiteFS) releasePath(path string) {
+	fs.writingMu.Lock()
+	defer fs.writingMu.Unlock()
+	delete(fs.writing, path)
 }